@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/processor"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// envPrefix is the prefix of environment variables that override settings,
+// e.g. TRANSFORMIMGS_CACHE overrides -cache flag.
+const envPrefix = "TRANSFORMIMGS_"
+
+// Config is the configuration of the application. It's loaded from the YAML or JSON
+// file set by -config flag. Settings from the file are overridden by environment variables
+// and then by flags.
+type Config struct {
+	ConfigFile string `yaml:"-"`
+
+	Listen       string        `yaml:"listen"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+
+	ImConvert  string           `yaml:"imConvert"`
+	ImIdentify string           `yaml:"imIdentify"`
+	ImArgs     []string         `yaml:"imArgs"`
+	ImLimits   processor.Limits `yaml:"imLimits"`
+	Proc       int              `yaml:"proc"`
+
+	Cache           int  `yaml:"cache"`
+	ErrorCache      int  `yaml:"errorCache"`
+	DisableSaveData bool `yaml:"disableSaveData"`
+	ServerTiming    bool `yaml:"serverTiming"`
+	DebugHeaders    bool `yaml:"debugHeaders"`
+
+	Loader               string   `yaml:"loader"`
+	FileRoot             string   `yaml:"fileRoot"`
+	S3Bucket             string   `yaml:"s3Bucket"`
+	S3Prefix             string   `yaml:"s3Prefix"`
+	Origins              []string `yaml:"origins"`
+	AllowedHosts         []string `yaml:"allowedHosts"`
+	BlockPrivateNetworks bool     `yaml:"blockPrivateNetworks"`
+	MaxSize              int64    `yaml:"maxSize"`
+	MaxPixels            int      `yaml:"maxPixels"`
+
+	MemoryCacheSize  int64         `yaml:"memoryCacheSize"`
+	DiskCacheDir     string        `yaml:"diskCacheDir"`
+	DiskCacheSize    int64         `yaml:"diskCacheSize"`
+	RevalidateSource bool          `yaml:"revalidateSource"`
+	CacheExpire      time.Duration `yaml:"cacheExpire"`
+
+	QueueMaxLength int           `yaml:"queueMaxLength"`
+	QueueMaxWait   time.Duration `yaml:"queueMaxWait"`
+	Budget         int           `yaml:"budget"`
+
+	SignatureKeys   []string      `yaml:"signatureKeys"`
+	ApiKeys         string        `yaml:"apiKeys"`
+	RateLimitBy     string        `yaml:"rateLimitBy"`
+	TrustedProxies  []string      `yaml:"trustedProxies"`
+	RateLimitHits   img.RateLimit `yaml:"rateLimitHits"`
+	RateLimitMisses img.RateLimit `yaml:"rateLimitMisses"`
+
+	DisabledFormats []string                  `yaml:"disabledFormats"`
+	Presets         map[string]*img.Preset    `yaml:"presets"`
+	Watermarks      map[string]*img.Watermark `yaml:"watermarks"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:        ":8080",
+		ReadTimeout:   5 * time.Second,
+		WriteTimeout:  10 * time.Second,
+		Proc:          runtime.NumCPU(),
+		Cache:         2592000,
+		ErrorCache:    60,
+		Loader:        "http",
+		DiskCacheSize: 1 << 30,
+		RateLimitBy:   "ip",
+	}
+}
+
+// loadConfig loads the configuration from the file, environment variables and
+// command line arguments in that order, so the later override the former.
+func loadConfig(args []string, output io.Writer) (*Config, error) {
+	cfg := defaultConfig()
+	fs := newFlagSet(cfg, output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	configFile := cfg.ConfigFile
+	if len(configFile) == 0 {
+		configFile = os.Getenv(envName("config"))
+	}
+
+	cfg = defaultConfig()
+	if len(configFile) > 0 {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not parse config file [%s]: %w", configFile, err)
+		}
+	}
+
+	fs = newFlagSet(cfg, output)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && envErr == nil && f.Name != "config" {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("invalid value [%s] of %s: %w", value, envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+	// New flag set, so repeatable flags override values from the environment
+	// rather than append to them.
+	fs = newFlagSet(cfg, output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg.ConfigFile = configFile
+
+	return cfg, nil
+}
+
+func newFlagSet(cfg *Config, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("transformimgs", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&cfg.ConfigFile, "config", "", "Path to YAML or JSON config file. Settings from the file are overridden by "+envPrefix+"* environment variables and flags")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "Address to listen on")
+	fs.DurationVar(&cfg.ReadTimeout, "readTimeout", cfg.ReadTimeout, "Maximum duration for reading the request")
+	fs.DurationVar(&cfg.WriteTimeout, "writeTimeout", cfg.WriteTimeout, "Maximum duration before timing out writes of the response")
+	fs.StringVar(&cfg.ImConvert, "imConvert", cfg.ImConvert, "Imagemagick convert command")
+	fs.StringVar(&cfg.ImIdentify, "imIdentify", cfg.ImIdentify, "Imagemagick identify command")
+	fs.IntVar(&cfg.Cache, "cache", cfg.Cache,
+		"Number of seconds to cache image after transformation (0 to disable cache). Default value is 2592000 (30 days)")
+	fs.IntVar(&cfg.ErrorCache, "errorCache", cfg.ErrorCache,
+		"Number of seconds to cache client error responses, e.g. when source image is not found (0 to disable cache)")
+	fs.IntVar(&cfg.Proc, "proc", cfg.Proc, "Number of images processors to run. Defaults to number of CPUs")
+	fs.BoolVar(&cfg.DisableSaveData, "disableSaveData", cfg.DisableSaveData, "If set to true then will disable Save-Data client hint. Could be useful for CDNs that don't support Save-Data header in Vary.")
+	fs.StringVar(&cfg.Loader, "loader", cfg.Loader, "Loader of source images: \"http\", \"file\" or \"s3\"")
+	fs.StringVar(&cfg.FileRoot, "fileRoot", cfg.FileRoot, "Directory to load images from when using \"file\" loader")
+	fs.StringVar(&cfg.S3Bucket, "s3Bucket", cfg.S3Bucket, "Bucket to load images from when using \"s3\" loader. Endpoint and credentials are read from AWS_* environment variables")
+	fs.StringVar(&cfg.S3Prefix, "s3Prefix", cfg.S3Prefix, "Prefix of the objects' keys when using \"s3\" loader")
+	fs.Var(&originsFlag{origins: &cfg.Origins}, "origin", "Origin alias in the format alias=target[,fallbackTarget], e.g. products/=s3://bucket/products/. "+
+		"Target could be an URL, S3 bucket or a directory. Could be repeated")
+	fs.Var((*listFlag)(&cfg.AllowedHosts), "allowedHosts", "Comma separated list of hosts that images could be loaded from, e.g. example.com,*.example.com. All hosts are allowed if empty")
+	fs.BoolVar(&cfg.BlockPrivateNetworks, "blockPrivateNetworks", cfg.BlockPrivateNetworks, "If set to true then images can't be loaded from loopback, private and link-local addresses")
+	fs.Int64Var(&cfg.MaxSize, "maxSize", cfg.MaxSize, "Maximum size of the source image in bytes. Bigger images are rejected with 413 error. 0 means no limit")
+	fs.IntVar(&cfg.MaxPixels, "maxPixels", cfg.MaxPixels, "Maximum number of pixels (width * height) of the source image. Bigger images are rejected with 422 error. 0 means no limit")
+	fs.StringVar(&cfg.ImLimits.Memory, "imLimitMemory", cfg.ImLimits.Memory, "ImageMagick memory limit, e.g. 256MiB")
+	fs.StringVar(&cfg.ImLimits.Map, "imLimitMap", cfg.ImLimits.Map, "ImageMagick memory map limit, e.g. 512MiB")
+	fs.StringVar(&cfg.ImLimits.Disk, "imLimitDisk", cfg.ImLimits.Disk, "ImageMagick disk limit, e.g. 1GiB")
+	fs.IntVar(&cfg.ImLimits.Time, "imLimitTime", cfg.ImLimits.Time, "ImageMagick time limit in seconds")
+	fs.Int64Var(&cfg.MemoryCacheSize, "memoryCacheSize", cfg.MemoryCacheSize, "Size of the in-memory cache of transformed images in bytes. 0 means the cache is disabled")
+	fs.StringVar(&cfg.DiskCacheDir, "diskCacheDir", cfg.DiskCacheDir, "Directory to cache source and transformed images in. The disk cache is disabled if empty")
+	fs.Int64Var(&cfg.DiskCacheSize, "diskCacheSize", cfg.DiskCacheSize, "Size of the disk cache in bytes")
+	fs.DurationVar(&cfg.CacheExpire, "cacheExpire", cfg.CacheExpire, "Time after which images in memory and disk caches expire, e.g. 24h, so changed source images are transformed again. Defaults to cache")
+	fs.BoolVar(&cfg.RevalidateSource, "revalidateSource", cfg.RevalidateSource, "If set to true then source images from the disk cache are revalidated on the origin using ETag and Last-Modified")
+	fs.IntVar(&cfg.QueueMaxLength, "queueMaxLength", cfg.QueueMaxLength, "Maximum number of images waiting for transformation in the queue. "+
+		"New requests are rejected with 503 error when the queue is full. 0 means no limit")
+	fs.DurationVar(&cfg.QueueMaxWait, "queueMaxWait", cfg.QueueMaxWait, "Maximum time that an image could wait for transformation in the queue, e.g. 5s. "+
+		"Requests that waited longer are rejected with 503 error. 0 means no limit")
+	fs.IntVar(&cfg.Budget, "budget", cfg.Budget, "Total cost of transformations executed at the same time, where 4 is roughly the cost of processing 1 megapixel JPEG image. "+
+		"Encoding to AVIF and JPEG XL costs more than WebP. Defaults to proc * 4")
+	fs.BoolVar(&cfg.ServerTiming, "serverTiming", cfg.ServerTiming, "If set to true then Server-Timing header with the time spent on loading and transforming images is added to responses")
+	fs.BoolVar(&cfg.DebugHeaders, "debugHeaders", cfg.DebugHeaders, "If set to true then X-Transform-* headers with the chosen output format and quality are added to responses")
+	fs.Var((*listFlag)(&cfg.SignatureKeys), "signatureKeys", "Comma separated list of keys to verify signatures of URLs. The first key is used to sign URLs. "+
+		"Signatures are not required if empty")
+	fs.StringVar(&cfg.ApiKeys, "apiKeys", cfg.ApiKeys, "Path to JSON file with API keys. If set then requests must have a valid API key in \"auth\" query param or X-Api-Key header")
+	fs.StringVar(&cfg.RateLimitBy, "rateLimitBy", cfg.RateLimitBy, "Client that rate limits are applied to: \"ip\", \"key\" (API key, requires apiKeys) or \"host\" (host of the source image)")
+	fs.Var((*listFlag)(&cfg.TrustedProxies), "trustedProxies", "Comma separated list of IPs or CIDRs of proxies that X-Forwarded-For header is accepted from, e.g. 10.0.0.0/8")
+	fs.Float64Var(&cfg.RateLimitHits.Rate, "rateLimitHits", cfg.RateLimitHits.Rate, "Number of requests per second served from the cache per client. 0 means no limit")
+	fs.IntVar(&cfg.RateLimitHits.Burst, "rateLimitHitsBurst", cfg.RateLimitHits.Burst, "Number of requests served from the cache that client could make at once. Defaults to rateLimitHits")
+	fs.Float64Var(&cfg.RateLimitMisses.Rate, "rateLimitMisses", cfg.RateLimitMisses.Rate, "Number of transformations per second per client. 0 means no limit")
+	fs.IntVar(&cfg.RateLimitMisses.Burst, "rateLimitMissesBurst", cfg.RateLimitMisses.Burst, "Number of transformations that client could request at once. Defaults to rateLimitMisses")
+	fs.Var((*listFlag)(&cfg.DisabledFormats), "disabledFormats", "Comma separated list of output formats that won't be used, e.g. image/avif,image/jxl")
+
+	return fs
+}
+
+// restartRequired returns names of the changed settings that are applied only on restart.
+func restartRequired(old *Config, new *Config) []string {
+	var names []string
+	check := func(name string, changed bool) {
+		if changed {
+			names = append(names, name)
+		}
+	}
+
+	check("listen", old.Listen != new.Listen)
+	check("readTimeout", old.ReadTimeout != new.ReadTimeout)
+	check("writeTimeout", old.WriteTimeout != new.WriteTimeout)
+	check("proc", old.Proc != new.Proc)
+	check("cache", old.Cache != new.Cache)
+	check("errorCache", old.ErrorCache != new.ErrorCache)
+	check("disableSaveData", old.DisableSaveData != new.DisableSaveData)
+	check("serverTiming", old.ServerTiming != new.ServerTiming)
+	check("debugHeaders", old.DebugHeaders != new.DebugHeaders)
+	check("memoryCacheSize", old.MemoryCacheSize != new.MemoryCacheSize)
+	check("diskCacheDir", old.DiskCacheDir != new.DiskCacheDir)
+	check("diskCacheSize", old.DiskCacheSize != new.DiskCacheSize)
+	check("cacheExpire", old.CacheExpire != new.CacheExpire)
+	check("queueMaxLength", old.QueueMaxLength != new.QueueMaxLength)
+	check("queueMaxWait", old.QueueMaxWait != new.QueueMaxWait)
+	check("budget", old.Budget != new.Budget)
+
+	return names
+}
+
+// envName returns the name of environment variable that overrides the flag,
+// e.g. TRANSFORMIMGS_IM_LIMIT_MEMORY for imLimitMemory.
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	for i, r := range flagName {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteRune('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// listFlag is a flag with comma separated list of values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/dooman87/kolibri/test"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write config: %+v", err)
+	}
+	return file
+}
+
+func TestLoadConfig_Origins(t *testing.T) {
+	file := writeConfig(t, `
+origins:
+  - products/=https://products.com/
+  - assets/=/var/assets/
+`)
+
+	cfg, err := loadConfig([]string{"-config", file}, io.Discard)
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(2, len(cfg.Origins), "number of origins from file"),
+	)
+
+	cfg, err = loadConfig([]string{"-config", file, "-origin", "images/=/var/images/", "-origin", "logos/=/var/logos/"}, io.Discard)
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(2, len(cfg.Origins), "number of origins from flags"),
+		test.Equal("images/=/var/images/", cfg.Origins[0], "first origin"),
+		test.Equal("logos/=/var/logos/", cfg.Origins[1], "second origin"),
+	)
+}
+
+func TestLoadConfig_OriginsEnv(t *testing.T) {
+	file := writeConfig(t, `
+origins:
+  - products/=https://products.com/
+`)
+	t.Setenv(envName("origin"), "images/=/var/images/")
+
+	cfg, err := loadConfig([]string{"-config", file}, io.Discard)
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(1, len(cfg.Origins), "number of origins from env"),
+		test.Equal("images/=/var/images/", cfg.Origins[0], "origin from env"),
+	)
+
+	cfg, err = loadConfig([]string{"-config", file, "-origin", "logos/=/var/logos/"}, io.Discard)
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(1, len(cfg.Origins), "number of origins from flags"),
+		test.Equal("logos/=/var/logos/", cfg.Origins[0], "origin from flag"),
+	)
+}
@@ -1,59 +1,71 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
 	"github.com/Pixboost/transformimgs/v8/img/processor"
 	"github.com/dooman87/kolibri/health"
+	"github.com/gorilla/mux"
 	"net/http"
 	"os"
-	"runtime"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 func main() {
-	var (
-		im              string
-		imIdent         string
-		cache           int
-		procNum         int
-		disableSaveData bool
-	)
-	flag.StringVar(&im, "imConvert", "", "Imagemagick convert command")
-	flag.StringVar(&imIdent, "imIdentify", "", "Imagemagick identify command")
-	flag.IntVar(&cache, "cache", 2592000,
-		"Number of seconds to cache image after transformation (0 to disable cache). Default value is 2592000 (30 days)")
-	flag.IntVar(&procNum, "proc", runtime.NumCPU(), "Number of images processors to run. Defaults to number of CPUs")
-	flag.BoolVar(&disableSaveData, "disableSaveData", false, "If set to true then will disable Save-Data client hint. Could be useful for CDNs that don't support Save-Data header in Vary.")
-	flag.Parse()
-
-	p, err := processor.NewImageMagick(im, imIdent)
-
-	if err != nil {
-		img.Log.Errorf("Can't create image magic processor: %+v", err)
+	cfg, err := loadConfig(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		img.Log.Errorf("Can't load configuration: %+v", err)
 		os.Exit(1)
 	}
 
-	img.CacheTTL = cache
-	img.SaveDataEnabled = !disableSaveData
-	srv, err := img.NewService(&loader.Http{}, p, procNum)
+	shutdownTracing, err := setupTracing()
 	if err != nil {
+		img.Log.Errorf("Can't configure tracing: %+v", err)
+		os.Exit(1)
+	}
+
+	img.CacheTTL = cfg.Cache
+	img.ErrorCacheTTL = cfg.ErrorCache
+	img.SaveDataEnabled = !cfg.DisableSaveData
+	img.ServerTimingEnabled = cfg.ServerTiming
+	img.DebugHeadersEnabled = cfg.DebugHeaders
+
+	a := &app{cfg: cfg}
+	if err = a.init(); err != nil {
 		img.Log.Errorf("Can't create image service: %+v", err)
 		os.Exit(2)
 	}
 
-	router := srv.GetRouter()
-	router.HandleFunc("/health", health.Health)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			a.reload(os.Args[1:])
+		}
+	}()
 
-	img.Log.Printf("Running the application on port 8080...\n")
+	img.Log.Printf("Running the application on [%s]...\n", cfg.Listen)
 	server := http.Server{
-		Addr:         ":8080",
-		Handler:      router,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:         cfg.Listen,
+		Handler:      a,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	}
 	err = server.ListenAndServe()
+	_ = shutdownTracing(context.Background())
 
 	if err != nil {
 		img.Log.Errorf("Error while stopping application: %+v", err)
@@ -61,3 +73,202 @@ func main() {
 	}
 	os.Exit(0)
 }
+
+// app serves requests using the router that is rebuilt when the configuration
+// is reloaded. Caches and the queue of transformations are created once and shared
+// by all routers, so reloading doesn't drop cached images and running transformations.
+type app struct {
+	cfg         *Config
+	reloadMux   sync.Mutex
+	router      atomic.Value
+	diskCache   *img.DiskCache
+	resultCache img.Cache
+	queue       *img.Queue
+}
+
+func (a *app) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	a.router.Load().(*mux.Router).ServeHTTP(resp, req)
+}
+
+// init creates caches and the router.
+func (a *app) init() error {
+	var resultCache img.TieredCache
+	cacheExpire := a.cfg.CacheExpire
+	if cacheExpire == 0 {
+		cacheExpire = time.Duration(a.cfg.Cache) * time.Second
+	}
+	if a.cfg.MemoryCacheSize > 0 {
+		memoryCache := img.NewMemoryCache(a.cfg.MemoryCacheSize)
+		memoryCache.TTL = cacheExpire
+		resultCache = append(resultCache, memoryCache)
+	}
+	if len(a.cfg.DiskCacheDir) > 0 {
+		diskCache, err := img.NewDiskCache(a.cfg.DiskCacheDir, a.cfg.DiskCacheSize)
+		if err != nil {
+			return fmt.Errorf("can't create disk cache: %w", err)
+		}
+		diskCache.TTL = cacheExpire
+		a.diskCache = diskCache
+		resultCache = append(resultCache, diskCache)
+	}
+	if len(resultCache) == 1 {
+		a.resultCache = resultCache[0]
+	} else if len(resultCache) > 1 {
+		a.resultCache = resultCache
+	}
+
+	router, err := a.newRouter(a.cfg)
+	if err != nil {
+		return err
+	}
+	a.router.Store(router)
+
+	return nil
+}
+
+// reload loads the configuration again and replaces the router. Requests that are
+// being processed are finished by the old router. If the new configuration is not valid
+// then the old router is kept.
+func (a *app) reload(args []string) {
+	a.reloadMux.Lock()
+	defer a.reloadMux.Unlock()
+
+	img.Log.Printf("Reloading configuration...\n")
+	cfg, err := loadConfig(args, os.Stderr)
+	if err != nil {
+		img.Log.Errorf("Can't reload configuration: %+v", err)
+		return
+	}
+	if changed := restartRequired(a.cfg, cfg); len(changed) > 0 {
+		img.Log.Printf("WARNING: changes of [%s] will be applied after restart\n", strings.Join(changed, ", "))
+	}
+
+	router, err := a.newRouter(cfg)
+	if err != nil {
+		img.Log.Errorf("Can't reload configuration: %+v", err)
+		return
+	}
+	a.router.Store(router)
+	a.cfg = cfg
+	img.Log.Printf("Configuration is reloaded\n")
+}
+
+// newRouter creates the processor, the loader and the service using the configuration.
+func (a *app) newRouter(cfg *Config) (*mux.Router, error) {
+	p, err := processor.NewImageMagick(cfg.ImConvert, cfg.ImIdentify)
+	if err != nil {
+		return nil, fmt.Errorf("can't create image magic processor: %w", err)
+	}
+	p.AdditionalArgs = append(p.AdditionalArgs, cfg.ImArgs...)
+	p.MaxPixels = cfg.MaxPixels
+	p.Limits = cfg.ImLimits
+
+	l, err := newLoader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if a.diskCache != nil {
+		l = &loader.Cached{Loader: l, Cache: a.diskCache, Revalidate: cfg.RevalidateSource}
+	}
+
+	srv, err := img.NewService(l, p, cfg.Proc)
+	if err != nil {
+		return nil, err
+	}
+	if a.queue == nil {
+		srv.Q.MaxLength = cfg.QueueMaxLength
+		srv.Q.MaxWait = cfg.QueueMaxWait
+		if cfg.Budget > 0 {
+			srv.Q.Budget = cfg.Budget
+		}
+		a.queue = srv.Q
+	}
+	srv.Q = a.queue
+	srv.Cache = a.resultCache
+	for name, preset := range cfg.Presets {
+		if preset == nil {
+			return nil, fmt.Errorf("preset [%s] is empty", name)
+		}
+		if err := preset.Validate(); err != nil {
+			return nil, fmt.Errorf("preset [%s] is invalid: %w", name, err)
+		}
+	}
+	srv.Presets = cfg.Presets
+	srv.DisabledFormats = cfg.DisabledFormats
+	for name, watermark := range cfg.Watermarks {
+		if watermark == nil {
+			return nil, fmt.Errorf("watermark [%s] is empty", name)
+		}
+		if err := watermark.Validate(); err != nil {
+			return nil, fmt.Errorf("watermark [%s] is invalid: %w", name, err)
+		}
+	}
+	srv.Watermarks = cfg.Watermarks
+
+	if len(cfg.SignatureKeys) > 0 {
+		srv.Signer, err = img.NewSigner(cfg.SignatureKeys...)
+		if err != nil {
+			return nil, fmt.Errorf("can't configure signature keys: %w", err)
+		}
+	}
+	if len(cfg.ApiKeys) > 0 {
+		keys, err := img.NewFileKeyStore(cfg.ApiKeys)
+		if err != nil {
+			return nil, fmt.Errorf("can't load API keys: %w", err)
+		}
+		srv.Keys = keys
+	}
+	if cfg.RateLimitHits.Rate > 0 || cfg.RateLimitMisses.Rate > 0 {
+		// Clients could send random keys to bypass the limits if keys are not validated
+		if cfg.RateLimitBy == "key" && srv.Keys == nil {
+			return nil, fmt.Errorf("rate limits by API key require apiKeys to be set")
+		}
+		srv.RateLimiter, err = createRateLimiter(cfg.RateLimitBy, cfg.TrustedProxies, cfg.RateLimitHits, cfg.RateLimitMisses)
+		if err != nil {
+			return nil, fmt.Errorf("can't configure rate limits: %w", err)
+		}
+	}
+
+	router := srv.GetRouter()
+	router.HandleFunc("/health", health.Health)
+	router.Handle("/metrics", metrics.Handler())
+
+	return router, nil
+}
+
+// newLoader creates the loader of source images.
+func newLoader(cfg *Config) (img.Loader, error) {
+	var l img.Loader
+	switch cfg.Loader {
+	case "http":
+		l = &loader.Http{
+			AllowedHosts:         cfg.AllowedHosts,
+			BlockPrivateNetworks: cfg.BlockPrivateNetworks,
+			MaxSize:              cfg.MaxSize,
+		}
+	case "file":
+		if len(cfg.FileRoot) == 0 {
+			return nil, fmt.Errorf("directory to load images from should be set by -fileRoot flag")
+		}
+		l = &loader.File{Root: cfg.FileRoot, MaxSize: cfg.MaxSize}
+	case "s3":
+		s3Loader, err := loader.NewS3FromEnv(cfg.S3Bucket, cfg.S3Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("can't create S3 loader: %w", err)
+		}
+		s3Loader.MaxSize = cfg.MaxSize
+		l = s3Loader
+	default:
+		return nil, fmt.Errorf("unknown loader [%s]", cfg.Loader)
+	}
+
+	if len(cfg.Origins) > 0 {
+		router, err := createRouter(cfg, l)
+		if err != nil {
+			return nil, fmt.Errorf("can't configure origins: %w", err)
+		}
+		l = router
+	}
+
+	return l, nil
+}
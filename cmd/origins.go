@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"net/url"
+	"strings"
+)
+
+// originsFlag is a repeatable flag of origin aliases in the format
+// alias=target[,fallbackTarget]. The first value set through the flag replaces
+// the origins from the previous configuration layer, and the following ones are
+// appended.
+type originsFlag struct {
+	origins *[]string
+	set     bool
+}
+
+func (o *originsFlag) String() string {
+	if o == nil || o.origins == nil {
+		return ""
+	}
+	return strings.Join(*o.origins, " ")
+}
+
+func (o *originsFlag) Set(value string) error {
+	if !o.set {
+		*o.origins = nil
+		o.set = true
+	}
+	*o.origins = append(*o.origins, value)
+	return nil
+}
+
+// createRouter creates a loader that routes aliases to the origins configured
+// in cfg and all other sources to the default loader.
+func createRouter(cfg *Config, defaultLoader img.Loader) (*loader.Router, error) {
+	router := &loader.Router{
+		Default: defaultLoader,
+	}
+
+	for _, origin := range cfg.Origins {
+		alias, targets, found := strings.Cut(origin, "=")
+		if !found || len(alias) == 0 || len(targets) == 0 {
+			return nil, fmt.Errorf("origin should be in format alias=target[,fallbackTarget], but got [%s]", origin)
+		}
+
+		targetsList := strings.Split(targets, ",")
+		if len(targetsList) > 2 {
+			return nil, fmt.Errorf("only one fallback target is supported, but got [%s]", origin)
+		}
+
+		route := &loader.Route{
+			Prefix: alias,
+		}
+		var err error
+		route.Loader, err = createLoader(targetsList[0], cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(targetsList) == 2 {
+			route.Fallback, err = createLoader(targetsList[1], cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		router.Routes = append(router.Routes, route)
+	}
+
+	return router, nil
+}
+
+// createLoader creates a loader for the given target that could be:
+// * http(s)://host/path/ - images will be loaded from the URL with the source appended.
+// The URL must end with "/" and images could be loaded from its host only.
+// * s3://bucket/prefix/ - images will be loaded from the S3 bucket
+// * /path/to/dir - images will be loaded from the local directory
+func createLoader(target string, cfg *Config) (img.Loader, error) {
+	maxSize := cfg.MaxSize
+	switch {
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		if !strings.HasSuffix(target, "/") {
+			return nil, fmt.Errorf("HTTP target must end with \"/\", but got [%s]", target)
+		}
+		httpUrl, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP target [%s]: %w", target, err)
+		}
+		return &loader.Http{
+			BaseUrl:              target,
+			AllowedHosts:         []string{httpUrl.Hostname()},
+			BlockPrivateNetworks: cfg.BlockPrivateNetworks,
+			MaxSize:              maxSize,
+		}, nil
+	case strings.HasPrefix(target, "s3://"):
+		s3Url, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 target [%s]: %w", target, err)
+		}
+		s3Loader, err := loader.NewS3FromEnv(s3Url.Host, strings.TrimPrefix(s3Url.Path, "/"))
+		if err != nil {
+			return nil, err
+		}
+		s3Loader.MaxSize = maxSize
+		return s3Loader, nil
+	case len(target) > 0:
+		return &loader.File{Root: target, MaxSize: maxSize}, nil
+	}
+
+	return nil, fmt.Errorf("target of the origin must not be empty")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net"
+	"strings"
+)
+
+// createRateLimiter creates a rate limiter that limits clients identified by
+// "ip", "key" or "host". trustedProxies is a list of IPs or CIDRs of proxies
+// that X-Forwarded-For header is accepted from.
+func createRateLimiter(by string, trustedProxies []string, hits img.RateLimit, misses img.RateLimit) (*img.RateLimiter, error) {
+	var proxies []*net.IPNet
+	for _, cidr := range trustedProxies {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, proxy, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse trusted proxy [%s]: %w", cidr, err)
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	limiter := &img.RateLimiter{
+		Hits:   hits,
+		Misses: misses,
+	}
+	switch by {
+	case "ip":
+		limiter.Client = img.ClientIP(proxies)
+	case "key":
+		limiter.Client = img.ClientApiKey(img.ClientIP(proxies))
+	case "host":
+		limiter.Client = img.ClientOriginHost
+	default:
+		return nil, fmt.Errorf("rate limit client should be one of \"ip\", \"key\" or \"host\", but got [%s]", by)
+	}
+
+	return limiter, nil
+}
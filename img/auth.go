@@ -0,0 +1,155 @@
+package img
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	// AuthParam is the query parameter with the API key.
+	AuthParam = "auth"
+	// AuthHeader is the header with the API key. It's used when the query parameter is not set.
+	AuthHeader = "X-Api-Key"
+)
+
+// ApiKey is the API key with the restrictions of its usage.
+type ApiKey struct {
+	// Key is the value of the key passed by clients.
+	Key string `json:"key"`
+	// Domains is the list of hosts of source images that could be transformed using the key.
+	// The pattern that starts with "*." matches all subdomains, e.g. "*.example.com".
+	// Sources without host, e.g. origin aliases of Router, are matched by patterns that
+	// end with "/" and are the prefix of the source, e.g. "products/".
+	// If empty, then images from any host could be transformed.
+	Domains []string `json:"domains,omitempty"`
+	// Referers is the list of hosts of pages that could use the key, checked using Referer header.
+	// The pattern that starts with "*." matches all subdomains. If empty, then Referer is not checked.
+	Referers []string `json:"referers,omitempty"`
+}
+
+// KeyStore stores API keys.
+type KeyStore interface {
+	// Get returns the API key or false if the key doesn't exist.
+	Get(key string) (*ApiKey, bool)
+}
+
+// FileKeyStore is a KeyStore with API keys loaded from JSON file. The file should
+// contain an array of keys, e.g.
+//
+//	[
+//	  {"key": "secret", "domains": ["images.example.com"], "referers": ["*.example.com"]}
+//	]
+type FileKeyStore struct {
+	keys map[string]*ApiKey
+}
+
+// NewFileKeyStore loads API keys from the JSON file.
+func NewFileKeyStore(path string) (*FileKeyStore, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read API keys file: %w", err)
+	}
+
+	var keys []*ApiKey
+	if err = json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("could not parse API keys file [%s]: %w", path, err)
+	}
+
+	s := &FileKeyStore{keys: make(map[string]*ApiKey, len(keys))}
+	for _, k := range keys {
+		if len(k.Key) == 0 {
+			return nil, fmt.Errorf("API key must not be empty in [%s]", path)
+		}
+		s.keys[k.Key] = k
+	}
+
+	return s, nil
+}
+
+func (s *FileKeyStore) Get(key string) (*ApiKey, bool) {
+	k, ok := s.keys[key]
+	return k, ok
+}
+
+// authenticate checks that the request has a valid API key that allows to transform
+// the image. Returns 401 HttpError if the key is missing or not valid and 403 HttpError if
+// the image or the referer is not allowed for the key.
+//
+// The response varies by the key header and by Referer if the key is restricted to referers,
+// so CDNs don't serve responses allowed for one client to others.
+func authenticate(keys KeyStore, resp http.ResponseWriter, req *http.Request, imgUrl string) error {
+	key, _ := getQueryParam(req.URL, AuthParam)
+	if len(key) == 0 {
+		key = req.Header.Get(AuthHeader)
+	}
+	if len(key) == 0 {
+		return NewHttpError(http.StatusUnauthorized, "API key is required")
+	}
+
+	apiKey, ok := keys.Get(key)
+	if !ok {
+		return NewHttpError(http.StatusUnauthorized, "API key is not valid")
+	}
+
+	if len(apiKey.Referers) > 0 {
+		resp.Header().Add("Vary", AuthHeader+", Referer")
+	} else {
+		resp.Header().Add("Vary", AuthHeader)
+	}
+
+	if len(apiKey.Domains) > 0 {
+		host := ""
+		if u, err := url.Parse(imgUrl); err == nil {
+			host = u.Hostname()
+		}
+		if len(host) == 0 && !matchPrefix(imgUrl, apiKey.Domains) {
+			return NewHttpError(http.StatusForbidden, fmt.Sprintf("transforming images [%s] is not allowed", imgUrl))
+		}
+		if len(host) > 0 && !matchHost(host, apiKey.Domains) {
+			return NewHttpError(http.StatusForbidden, fmt.Sprintf("transforming images from [%s] is not allowed", host))
+		}
+	}
+
+	if len(apiKey.Referers) > 0 {
+		host := ""
+		if u, err := url.Parse(req.Header.Get("Referer")); err == nil {
+			host = u.Hostname()
+		}
+		if !matchHost(host, apiKey.Referers) {
+			return NewHttpError(http.StatusForbidden, fmt.Sprintf("referer [%s] is not allowed", host))
+		}
+	}
+
+	return nil
+}
+
+// matchPrefix returns true if any of the patterns that end with "/" is the prefix of the source.
+func matchPrefix(src string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(src, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost returns true if the host matches any of the patterns. The pattern
+// that starts with "*." matches all subdomains.
+func matchHost(host string, patterns []string) bool {
+	if len(host) == 0 {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if host == p || (strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:])) {
+			return true
+		}
+	}
+	return false
+}
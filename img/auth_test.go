@@ -0,0 +1,169 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func createKeyStore(t *testing.T, content string) (*img.FileKeyStore, error) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write keys file: %s", err)
+	}
+	return img.NewFileKeyStore(path)
+}
+
+func TestNewFileKeyStore(t *testing.T) {
+	keys, err := createKeyStore(t, `[
+		{"key": "key1", "domains": ["site.com"]},
+		{"key": "key2", "referers": ["*.example.com"]}
+	]`)
+	if err != nil {
+		t.Fatalf("could not load keys: %s", err)
+	}
+
+	key1, key1Found := keys.Get("key1")
+	_, unknownFound := keys.Get("unknown")
+	_, invalidErr := createKeyStore(t, `{"key": "key1"}`)
+	_, emptyKeyErr := createKeyStore(t, `[{"domains": ["site.com"]}]`)
+	_, notFoundErr := img.NewFileKeyStore(filepath.Join(t.TempDir(), "not_found.json"))
+
+	test.Error(t,
+		test.Equal(true, key1Found, "key1 is found"),
+		test.Equal("site.com", key1.Domains[0], "key1 domains"),
+		test.Equal(false, unknownFound, "unknown key is found"),
+		test.NotNil(invalidErr, "error on invalid file"),
+		test.NotNil(emptyKeyErr, "error on empty key"),
+		test.NotNil(notFoundErr, "error on missing file"),
+	)
+}
+
+func TestService_ApiKeys(t *testing.T) {
+	keys, err := createKeyStore(t, `[
+		{"key": "any"},
+		{"key": "site", "domains": ["site.com"]},
+		{"key": "other", "domains": ["*.other.com"]},
+		{"key": "referer", "referers": ["example.com"]},
+		{"key": "alias", "domains": ["site.com", "products/"]}
+	]`)
+	if err != nil {
+		t.Fatalf("could not load keys: %s", err)
+	}
+	s := createService(t)
+	s.Keys = keys
+
+	withHeader := func(url string, name string, value string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set(name, value)
+		return req
+	}
+
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=any",
+			ExpectedCode: http.StatusOK,
+			Description:  "Key in the query",
+		},
+		{
+			Request:      withHeader("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", img.AuthHeader, "any"),
+			ExpectedCode: http.StatusOK,
+			Description:  "Key in the header",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("X-Api-Key, Accept, Save-Data", strings.Join(w.Header().Values("Vary"), ", "), "Vary header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis?auth=any",
+			ExpectedCode: http.StatusOK,
+			Description:  "Key for asis",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("X-Api-Key", strings.Join(w.Header().Values("Vary"), ", "), "Vary header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			ExpectedCode: http.StatusUnauthorized,
+			Description:  "No key",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=unknown",
+			ExpectedCode: http.StatusUnauthorized,
+			Description:  "Unknown key",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=site",
+			ExpectedCode: http.StatusOK,
+			Description:  "Allowed domain",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=other",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Not allowed domain",
+		},
+		{
+			Url:          "http://localhost/img/products/img.png/optimise?auth=alias",
+			ExpectedCode: http.StatusOK,
+			Description:  "Allowed alias",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=alias",
+			ExpectedCode: http.StatusOK,
+			Description:  "Allowed domain of the key with alias",
+		},
+		{
+			Url:          "http://localhost/img/categories/img.png/optimise?auth=alias",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Not allowed alias",
+		},
+		{
+			Url:          "http://localhost/img/products/img.png/optimise?auth=site",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Alias is not allowed by domain",
+		},
+		{
+			Request:      withHeader("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=referer", "Referer", "https://example.com/page.html"),
+			ExpectedCode: http.StatusOK,
+			Description:  "Allowed referer",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("X-Api-Key, Referer, Accept, Save-Data", strings.Join(w.Header().Values("Vary"), ", "), "Vary header"),
+				)
+			},
+		},
+		{
+			Request:      withHeader("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=referer", "Referer", "https://other.com/page.html"),
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Not allowed referer",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("X-Api-Key, Referer", strings.Join(w.Header().Values("Vary"), ", "), "Vary header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?auth=referer",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "No referer",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
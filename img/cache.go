@@ -0,0 +1,123 @@
+package img
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache stores transformed images, so the same transformation
+// won't be executed twice.
+//
+// Images returned by Get are shared between requests and must not be modified.
+type Cache interface {
+	// Get returns an image stored with the key. The second returned value
+	// is false if there is no image for the key.
+	Get(key string) (*Image, bool)
+	// Set stores an image with the key.
+	Set(key string, image *Image)
+}
+
+// MemoryCache is an in-memory Cache that holds images up to the configured
+// size and evicts the least recently used images when it's full.
+type MemoryCache struct {
+	// TTL is the time after which cached images expire, so changes of source
+	// images are picked up eventually. 0 means images don't expire.
+	TTL     time.Duration
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+	mux     sync.Mutex
+}
+
+type memoryCacheItem struct {
+	key     string
+	image   *Image
+	created time.Time
+}
+
+// NewMemoryCache creates a new cache that holds up to maxSize bytes of images' data.
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *MemoryCache) Get(key string) (*Image, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if c.TTL > 0 && time.Since(item.created) > c.TTL {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+
+	return item.image, true
+}
+
+func (c *MemoryCache) Set(key string, image *Image) {
+	imageSize := int64(len(image.Data))
+	if imageSize > c.maxSize {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+
+	for c.size+imageSize > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+
+	c.items[key] = c.lru.PushFront(&memoryCacheItem{key: key, image: image, created: time.Now()})
+	c.size += imageSize
+}
+
+// Size returns the size of the images' data stored in the cache in bytes.
+func (c *MemoryCache) Size() int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.size
+}
+
+func (c *MemoryCache) remove(elem *list.Element) {
+	item := c.lru.Remove(elem).(*memoryCacheItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.image.Data))
+}
+
+// TieredCache looks up images in the list of caches in order, e.g. in memory
+// and then on disk. Images found in the latter caches are put to the former ones.
+type TieredCache []Cache
+
+func (c TieredCache) Get(key string) (*Image, bool) {
+	for i, cache := range c {
+		if image, ok := cache.Get(key); ok {
+			for j := 0; j < i; j++ {
+				c[j].Set(key, image)
+			}
+			return image, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c TieredCache) Set(key string, image *Image) {
+	for _, cache := range c {
+		cache.Set(key, image)
+	}
+}
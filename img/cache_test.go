@@ -0,0 +1,87 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache_GetSet(t *testing.T) {
+	c := img.NewMemoryCache(10)
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+
+	cached, ok := c.Get("img1")
+	_, okMissing := c.Get("img2")
+
+	test.Error(t,
+		test.Equal(true, ok, "image is cached"),
+		test.Equal("1234", string(cached.Data), "cached image"),
+		test.Equal(false, okMissing, "missing image"),
+		test.Equal(int64(4), c.Size(), "cache size"),
+	)
+}
+
+func TestMemoryCache_EvictLeastRecentlyUsed(t *testing.T) {
+	c := img.NewMemoryCache(10)
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	c.Set("img2", &img.Image{Data: []byte("1234")})
+	c.Get("img1")
+	c.Set("img3", &img.Image{Data: []byte("1234")})
+
+	_, ok1 := c.Get("img1")
+	_, ok2 := c.Get("img2")
+	_, ok3 := c.Get("img3")
+
+	test.Error(t,
+		test.Equal(true, ok1, "recently used image is cached"),
+		test.Equal(false, ok2, "least recently used image is evicted"),
+		test.Equal(true, ok3, "new image is cached"),
+		test.Equal(int64(8), c.Size(), "cache size"),
+	)
+}
+
+func TestMemoryCache_Replace(t *testing.T) {
+	c := img.NewMemoryCache(10)
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	c.Set("img1", &img.Image{Data: []byte("12")})
+
+	cached, _ := c.Get("img1")
+
+	test.Error(t,
+		test.Equal("12", string(cached.Data), "cached image"),
+		test.Equal(int64(2), c.Size(), "cache size"),
+	)
+}
+
+func TestMemoryCache_TooBig(t *testing.T) {
+	c := img.NewMemoryCache(3)
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+
+	_, ok := c.Get("img1")
+
+	test.Error(t,
+		test.Equal(false, ok, "image is not cached"),
+		test.Equal(int64(0), c.Size(), "cache size"),
+	)
+}
+
+func TestMemoryCache_Expire(t *testing.T) {
+	c := img.NewMemoryCache(10)
+	c.TTL = 20 * time.Millisecond
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	_, okFresh := c.Get("img1")
+	time.Sleep(30 * time.Millisecond)
+	_, okExpired := c.Get("img1")
+
+	test.Error(t,
+		test.Equal(true, okFresh, "fresh image is cached"),
+		test.Equal(false, okExpired, "expired image is cached"),
+		test.Equal(int64(0), c.Size(), "cache size"),
+	)
+}
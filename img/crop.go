@@ -0,0 +1,191 @@
+package img
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Gravities of FitToSize. GravityFocus keeps Focus of ResizeConfig in the
+// center of the result image where possible.
+const (
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravityNorthEast = "northeast"
+	GravityEast      = "east"
+	GravitySouthEast = "southeast"
+	GravitySouth     = "south"
+	GravitySouthWest = "southwest"
+	GravityWest      = "west"
+	GravityNorthWest = "northwest"
+	GravityFocus     = "focus"
+)
+
+var gravities = map[string]bool{
+	GravityCenter:    true,
+	GravityNorth:     true,
+	GravityNorthEast: true,
+	GravityEast:      true,
+	GravitySouthEast: true,
+	GravitySouth:     true,
+	GravitySouthWest: true,
+	GravityWest:      true,
+	GravityNorthWest: true,
+}
+
+// Modes of FitToSize. ModeCrop crops everything out of the target size and ModePad resizes
+// the image to fit inside the target size and fills the rest with the background.
+const (
+	ModeCrop = "crop"
+	ModePad  = "pad"
+)
+
+// BackgroundTransparent is the transparent background of ModePad.
+const BackgroundTransparent = "transparent"
+
+var backgroundRegexp = regexp.MustCompile(`^#?([0-9a-f]{3}|[0-9a-f]{6})$`)
+
+// CropSmart is the crop strategy of FitToSize that keeps the most salient part of the image.
+const CropSmart = "smart"
+
+var cropStrategies = map[string]bool{
+	CropSmart: true,
+}
+
+// Point is a point on the image.
+type Point struct {
+	X float64
+	Y float64
+	// Percent is a flag whether coordinates are percents of the image size rather than pixels.
+	Percent bool
+}
+
+// CropConfig is the configuration of Crop transformation.
+type CropConfig struct {
+	// X and Y are coordinates of the top left corner of the rectangle to crop.
+	X float64
+	Y float64
+	// Width and Height are the size of the rectangle to crop.
+	Width  float64
+	Height float64
+	// Percent is a flag whether the rectangle is in percents of the image size rather than pixels.
+	Percent bool
+	// Size is an optional size of the cropped image in the format of ResizeConfig.
+	// If empty then the cropped image is not resized.
+	Size string
+}
+
+var coordinateRegexp = regexp.MustCompile(`^\d+(\.\d+)?%?$`)
+
+// maxCoordinate is the maximum coordinate in pixels, which is bigger than any image that could be processed.
+const maxCoordinate = 1 << 24
+
+// parseCoordinates parses comma separated list of coordinates in pixels or percents, e.g. 10,20 or 10%,20%.
+// All coordinates must be in the same units.
+func parseCoordinates(value string, num int) ([]float64, bool, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != num {
+		return nil, false, fmt.Errorf("expected %d comma separated numbers, but got [%s]", num, value)
+	}
+
+	coordinates := make([]float64, num)
+	percent := strings.HasSuffix(parts[0], "%")
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if !coordinateRegexp.MatchString(p) {
+			return nil, false, fmt.Errorf("expected a number of pixels or percents, but got [%s]", p)
+		}
+		if strings.HasSuffix(p, "%") != percent {
+			return nil, false, fmt.Errorf("expected all numbers in pixels or in percents, but got [%s]", value)
+		}
+
+		c, err := strconv.ParseFloat(strings.TrimSuffix(p, "%"), 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("expected a number of pixels or percents, but got [%s]", p)
+		}
+		if percent && c > 100 {
+			return nil, false, fmt.Errorf("percents must not be more than 100, but got [%s]", p)
+		}
+		if !percent && c > maxCoordinate {
+			return nil, false, fmt.Errorf("pixels must not be more than %d, but got [%s]", maxCoordinate, p)
+		}
+		coordinates[i] = c
+	}
+
+	return coordinates, percent, nil
+}
+
+// parseFocus parses the focal point in the format x,y in pixels or percents.
+func parseFocus(value string) (Point, error) {
+	c, percent, err := parseCoordinates(value, 2)
+	if err != nil {
+		return Point{}, err
+	}
+	return Point{X: c[0], Y: c[1], Percent: percent}, nil
+}
+
+// parseBackground parses the background color in the hex format RGB or RRGGBB with optional leading #
+// or "transparent". The color is returned in the format #rrggbb.
+func parseBackground(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == BackgroundTransparent {
+		return value, nil
+	}
+	if !backgroundRegexp.MatchString(value) {
+		return "", fmt.Errorf("expected hex color or transparent, but got [%s]", value)
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	return "#" + hex, nil
+}
+
+// parseCrop parses the rectangle in the format x,y,width,height in pixels or percents.
+func parseCrop(value string) (*CropConfig, error) {
+	c, percent, err := parseCoordinates(value, 4)
+	if err != nil {
+		return nil, err
+	}
+	if c[2] == 0 || c[3] == 0 {
+		return nil, fmt.Errorf("width and height must be positive, but got [%s]", value)
+	}
+	if percent && (c[0]+c[2] > 100 || c[1]+c[3] > 100) {
+		return nil, fmt.Errorf("rectangle must be inside the image, but got [%s]", value)
+	}
+	return &CropConfig{X: c[0], Y: c[1], Width: c[2], Height: c[3], Percent: percent}, nil
+}
+
+// CropUrl crops the rectangle from the image and optionally resizes it.
+func (r *Service) CropUrl(resp http.ResponseWriter, req *http.Request) {
+	rect, _ := getQueryParam(req.URL, "rect")
+	if len(rect) == 0 {
+		http.Error(resp, "rect param is required", http.StatusBadRequest)
+		return
+	}
+	config, err := parseCrop(rect)
+	if err != nil {
+		http.Error(resp, fmt.Sprintf("rect param should be in format x,y,width,height: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	size, _ := getQueryParam(req.URL, "size")
+	if len(size) > 0 {
+		if !resizeSizeRegexp.MatchString(size) {
+			http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
+			return
+		}
+		config.Size = size
+	}
+
+	// The rect is calculated on the source image before the border is trimmed
+	if trimBorder, _ := getBoolQueryParam(req.URL, "trim-border"); trimBorder {
+		http.Error(resp, "trim-border param is not supported by crop", http.StatusBadRequest)
+		return
+	}
+
+	r.transformUrl(resp, req, "crop", r.Processor.Crop, config)
+}
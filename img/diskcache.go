@@ -0,0 +1,317 @@
+package img
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskCacheTmpPrefix = "tmp-"
+
+// DiskCache is a Cache that stores images in the local directory, so cached images
+// survive restarts of the service. It holds images up to the configured size and
+// evicts the least recently used images when it's full.
+//
+// Each image is stored in a separate file named after the hash of the key.
+// Files are written to a temporary file first and then renamed, so partially written
+// images are never returned.
+type DiskCache struct {
+	// TTL is the time after which cached images expire, so changes of source
+	// images are picked up eventually. 0 means images don't expire.
+	TTL     time.Duration
+	dir     string
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+	mux     sync.Mutex
+}
+
+type diskCacheItem struct {
+	name string
+	size int64
+}
+
+// diskCacheMeta is stored in the first line of the cached file
+// and followed by the image data.
+type diskCacheMeta struct {
+	Key             string `json:"key"`
+	Id              string `json:"id"`
+	MimeType        string `json:"mimeType"`
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	ETag            string `json:"etag,omitempty"`
+	LastModified    string `json:"lastModified,omitempty"`
+	// Created is the time in Unix nanoseconds when the image was cached. Modification time
+	// of the file can't be used, because it's updated on each access to keep the order of images.
+	Created int64 `json:"created"`
+}
+
+// NewDiskCache creates a new cache in the directory that holds up to maxSize bytes.
+// Images that were cached before are picked up from the directory and
+// the least recently used of them are evicted if the cache is over the size.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("cache directory is not set")
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxSize must be positive, but got [%d]", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	Log.Printf("Disk cache in [%s] contains [%d] images of [%d] bytes\n", dir, c.lru.Len(), c.size)
+
+	return c, nil
+}
+
+func (c *DiskCache) Get(key string) (*Image, bool) {
+	name := c.fileName(key)
+
+	c.mux.Lock()
+	elem, ok := c.items[name]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mux.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	content, err := os.ReadFile(c.filePath(name))
+	if err != nil {
+		Log.Printf("Could not read cached image [%s]: %s\n", key, err)
+		c.delete(name)
+		return nil, false
+	}
+
+	meta, data, err := decodeDiskCacheFile(content)
+	if err != nil {
+		Log.Printf("Could not read cached image [%s]: %s\n", key, err)
+		c.delete(name)
+		return nil, false
+	}
+	if meta.Key != key {
+		return nil, false
+	}
+	if c.TTL > 0 && time.Since(time.Unix(0, meta.Created)) > c.TTL {
+		c.delete(name)
+		return nil, false
+	}
+
+	// Modification time is used to restore the order of images after restart
+	now := time.Now()
+	_ = os.Chtimes(c.filePath(name), now, now)
+
+	return &Image{
+		Id:              meta.Id,
+		Data:            data,
+		MimeType:        meta.MimeType,
+		ContentEncoding: meta.ContentEncoding,
+		ETag:            meta.ETag,
+		LastModified:    meta.LastModified,
+	}, true
+}
+
+func (c *DiskCache) Set(key string, image *Image) {
+	name := c.fileName(key)
+
+	content, err := encodeDiskCacheFile(&diskCacheMeta{
+		Key:             key,
+		Id:              image.Id,
+		MimeType:        image.MimeType,
+		ContentEncoding: image.ContentEncoding,
+		ETag:            image.ETag,
+		LastModified:    image.LastModified,
+		Created:         time.Now().UnixNano(),
+	}, image.Data)
+	if err != nil {
+		Log.Printf("Could not cache image [%s]: %s\n", key, err)
+		return
+	}
+	size := int64(len(content))
+	if size > c.maxSize {
+		return
+	}
+
+	if err = c.writeFile(name, content); err != nil {
+		Log.Printf("Could not cache image [%s]: %s\n", key, err)
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.items[name]; ok {
+		c.size -= elem.Value.(*diskCacheItem).size
+		c.lru.Remove(elem)
+	}
+	c.items[name] = c.lru.PushFront(&diskCacheItem{name: name, size: size})
+	c.size += size
+
+	c.evict()
+}
+
+// Size returns the size of the files stored in the cache in bytes.
+func (c *DiskCache) Size() int64 {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.size
+}
+
+// evict removes the least recently used images until the cache fits the max size.
+// Must be called with the lock held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxSize {
+		item := c.lru.Remove(c.lru.Back()).(*diskCacheItem)
+		delete(c.items, item.name)
+		c.size -= item.size
+
+		if err := os.Remove(c.filePath(item.name)); err != nil && !os.IsNotExist(err) {
+			Log.Printf("Could not remove cached image [%s]: %s\n", item.name, err)
+		}
+	}
+}
+
+func (c *DiskCache) delete(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if elem, ok := c.items[name]; ok {
+		c.size -= elem.Value.(*diskCacheItem).size
+		c.lru.Remove(elem)
+		delete(c.items, name)
+	}
+	_ = os.Remove(c.filePath(name))
+}
+
+func (c *DiskCache) writeFile(name string, content []byte) error {
+	filePath := c.filePath(name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, diskCacheTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// loadIndex restores the index of cached images from the directory using
+// modification time of files to order them.
+func (c *DiskCache) loadIndex() error {
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), diskCacheTmpPrefix) {
+			// Leftover from the interrupted write
+			return os.Remove(path)
+		}
+		if len(d.Name()) != sha256.Size*2 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{name: d.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read cache directory: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		c.items[f.name] = c.lru.PushBack(&diskCacheItem{name: f.name, size: f.size})
+		c.size += f.size
+	}
+	c.evict()
+
+	return nil
+}
+
+func (c *DiskCache) fileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// filePath returns the path to the cached file. Files are spread
+// across subdirectories to keep directories small.
+func (c *DiskCache) filePath(name string) string {
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+func encodeDiskCacheFile(meta *diskCacheMeta, data []byte) ([]byte, error) {
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, len(metaJson)+1+len(data))
+	content = append(content, metaJson...)
+	content = append(content, '\n')
+	content = append(content, data...)
+
+	return content, nil
+}
+
+func decodeDiskCacheFile(content []byte) (*diskCacheMeta, []byte, error) {
+	metaJson, data, found := bytes.Cut(content, []byte{'\n'})
+	if !found {
+		return nil, nil, fmt.Errorf("metadata is not found")
+	}
+
+	meta := &diskCacheMeta{}
+	if err := json.Unmarshal(metaJson, meta); err != nil {
+		return nil, nil, fmt.Errorf("could not parse metadata: %w", err)
+	}
+
+	return meta, data, nil
+}
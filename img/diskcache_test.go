@@ -0,0 +1,159 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createDiskCache(t *testing.T, dir string, maxSize int64) *img.DiskCache {
+	c, err := img.NewDiskCache(dir, maxSize)
+	if err != nil {
+		t.Fatalf("could not create disk cache: %s", err)
+	}
+	return c
+}
+
+func TestDiskCache_GetSet(t *testing.T) {
+	c := createDiskCache(t, t.TempDir(), 1024)
+
+	c.Set("img1", &img.Image{
+		Id:              "img1.svg",
+		Data:            []byte("12\n34"),
+		MimeType:        "image/svg+xml",
+		ContentEncoding: "gzip",
+		ETag:            `"123"`,
+		LastModified:    "Mon, 02 Jan 2023 15:04:05 GMT",
+	})
+
+	cached, ok := c.Get("img1")
+	_, okMissing := c.Get("img2")
+
+	test.Error(t,
+		test.Equal(true, ok, "image is cached"),
+		test.Equal("img1.svg", cached.Id, "image id"),
+		test.Equal("12\n34", string(cached.Data), "image data"),
+		test.Equal("image/svg+xml", cached.MimeType, "mime type"),
+		test.Equal("gzip", cached.ContentEncoding, "content encoding"),
+		test.Equal(`"123"`, cached.ETag, "ETag"),
+		test.Equal("Mon, 02 Jan 2023 15:04:05 GMT", cached.LastModified, "Last-Modified"),
+		test.Equal(false, okMissing, "missing image"),
+	)
+}
+
+func TestDiskCache_Restart(t *testing.T) {
+	dir := t.TempDir()
+	c := createDiskCache(t, dir, 1024)
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+
+	if err := os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+
+	restarted := createDiskCache(t, dir, 1024)
+	cached, ok := restarted.Get("img1")
+	_, tmpErr := os.Stat(filepath.Join(dir, "tmp-123"))
+
+	test.Error(t,
+		test.Equal(true, ok, "image is cached"),
+		test.Equal("1234", string(cached.Data), "image data"),
+		test.Equal(c.Size(), restarted.Size(), "cache size"),
+		test.Equal(true, os.IsNotExist(tmpErr), "temporary file is removed"),
+	)
+}
+
+func TestDiskCache_Expire(t *testing.T) {
+	dir := t.TempDir()
+	c := createDiskCache(t, dir, 1024)
+	c.TTL = 20 * time.Millisecond
+
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	_, okFresh := c.Get("img1")
+	time.Sleep(30 * time.Millisecond)
+	restarted := createDiskCache(t, dir, 1024)
+	restarted.TTL = c.TTL
+	_, okExpired := restarted.Get("img1")
+
+	test.Error(t,
+		test.Equal(true, okFresh, "fresh image is cached"),
+		test.Equal(false, okExpired, "expired image is cached after restart"),
+		test.Equal(int64(0), restarted.Size(), "cache size"),
+	)
+}
+
+func TestDiskCache_EvictLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c := createDiskCache(t, dir, 1024)
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	itemSize := c.Size()
+
+	c = createDiskCache(t, dir, itemSize*2)
+	c.Set("img2", &img.Image{Data: []byte("1234")})
+	c.Get("img1")
+	c.Set("img3", &img.Image{Data: []byte("1234")})
+
+	_, ok1 := c.Get("img1")
+	_, ok2 := c.Get("img2")
+	_, ok3 := c.Get("img3")
+
+	test.Error(t,
+		test.Equal(true, ok1, "recently used image is cached"),
+		test.Equal(false, ok2, "least recently used image is evicted"),
+		test.Equal(true, ok3, "new image is cached"),
+		test.Equal(itemSize*2, c.Size(), "cache size"),
+	)
+}
+
+func TestDiskCache_EvictOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	c := createDiskCache(t, dir, 1024)
+	c.Set("img1", &img.Image{Data: []byte("1234")})
+	// Making sure that modification time of images is different
+	time.Sleep(10 * time.Millisecond)
+	c.Set("img2", &img.Image{Data: []byte("1234")})
+	itemSize := c.Size() / 2
+
+	c = createDiskCache(t, dir, itemSize)
+	_, ok1 := c.Get("img1")
+	_, ok2 := c.Get("img2")
+
+	test.Error(t,
+		test.Equal(false, ok1, "older image is evicted"),
+		test.Equal(true, ok2, "newer image is cached"),
+	)
+}
+
+func TestNewDiskCache_Errors(t *testing.T) {
+	_, errNoDir := img.NewDiskCache("", 1024)
+	_, errNoSize := img.NewDiskCache(t.TempDir(), 0)
+
+	test.Error(t,
+		test.NotNil(errNoDir, "error when directory is not set"),
+		test.NotNil(errNoSize, "error when size is not set"),
+	)
+}
+
+func TestTieredCache(t *testing.T) {
+	memory := img.NewMemoryCache(1024)
+	disk := createDiskCache(t, t.TempDir(), 1024)
+	disk.Set("img1", &img.Image{Data: []byte("1234")})
+
+	c := img.TieredCache{memory, disk}
+	cached, ok := c.Get("img1")
+	_, okMemory := memory.Get("img1")
+
+	c.Set("img2", &img.Image{Data: []byte("12")})
+	_, okMemory2 := memory.Get("img2")
+	_, okDisk2 := disk.Get("img2")
+
+	test.Error(t,
+		test.Equal(true, ok, "image is cached"),
+		test.Equal("1234", string(cached.Data), "image data"),
+		test.Equal(true, okMemory, "image is put to the memory cache"),
+		test.Equal(true, okMemory2, "image is set to the memory cache"),
+		test.Equal(true, okDisk2, "image is set to the disk cache"),
+	)
+}
@@ -0,0 +1,161 @@
+package img
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces identical transformations that are executed concurrently,
+// so they share one load of the source image and one run of the processor.
+type flightGroup struct {
+	mux     sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	loaded  bool
+	etag    string
+	op      *Command
+	err     error
+	callers []*flightCaller
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type flightCaller struct {
+	notModified   func(etag string) bool
+	notModifiedCh chan struct{}
+	left          bool
+}
+
+// flightFunc executes the transformation. It should call loaded with ETag of
+// the result as soon as it's known, so callers could stop waiting for the result if
+// they already have it.
+type flightFunc func(ctx context.Context, loaded func(etag string)) (*Command, error)
+
+// errNotModified is returned to the caller that already has the result
+var errNotModified = NewHttpError(http.StatusNotModified, "not modified")
+
+// do executes fn once for all concurrent calls with the same key and returns its
+// result to all of them. The third returned value is true if the result was shared
+// with another call.
+//
+// fn is executed with a context that keeps values of ctx, but is cancelled only
+// when contexts of all callers are cancelled.
+//
+// notModified is called with ETag passed to the loaded callback. If it returns true then
+// the caller stops waiting and errNotModified is returned. If all callers stop waiting then
+// the context of fn is cancelled before loaded returns, so the transformation won't be executed.
+func (g *flightGroup) do(ctx context.Context, key string, fn flightFunc, notModified func(etag string) bool) (*Command, error, bool) {
+	caller := &flightCaller{
+		notModified:   notModified,
+		notModifiedCh: make(chan struct{}),
+	}
+
+	g.mux.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+
+	f, shared := g.flights[key]
+	if shared {
+		if f.loaded && notModified != nil && notModified(f.etag) {
+			g.mux.Unlock()
+			return nil, errNotModified, shared
+		}
+		f.callers = append(f.callers, caller)
+		f.waiters++
+	} else {
+		flightCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+		f = &flight{
+			done:    make(chan struct{}),
+			callers: []*flightCaller{caller},
+			waiters: 1,
+			cancel:  cancel,
+		}
+		g.flights[key] = f
+
+		go func() {
+			defer cancel()
+			f.op, f.err = fn(flightCtx, func(etag string) {
+				g.loaded(key, f, etag)
+			})
+
+			g.mux.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mux.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mux.Unlock()
+
+	select {
+	case <-f.done:
+		return f.op, f.err, shared
+	case <-caller.notModifiedCh:
+		return nil, errNotModified, shared
+	case <-ctx.Done():
+		g.mux.Lock()
+		g.leave(key, f, caller)
+		g.mux.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+// loaded releases callers that already have the result with the given ETag.
+func (g *flightGroup) loaded(key string, f *flight, etag string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	f.loaded = true
+	f.etag = etag
+	for _, caller := range f.callers {
+		if !caller.left && caller.notModified != nil && caller.notModified(etag) {
+			g.leave(key, f, caller)
+			close(caller.notModifiedCh)
+		}
+	}
+}
+
+// leave stops waiting for the flight and cancels it if there are no more callers waiting.
+// Must be called with the lock held.
+func (g *flightGroup) leave(key string, f *flight, caller *flightCaller) {
+	if caller.left {
+		return
+	}
+	caller.left = true
+
+	f.waiters--
+	if f.waiters == 0 {
+		f.cancel()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+	}
+}
+
+// detachedContext keeps values of the parent context, but is never cancelled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,112 @@
+package img_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingLoader waits for the release channel to be closed
+// or for the context to be cancelled before loading the image
+type blockingLoader struct {
+	loaderMock
+	release   chan struct{}
+	loads     int32
+	cancelled chan struct{}
+}
+
+func (l *blockingLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	atomic.AddInt32(&l.loads, 1)
+	select {
+	case <-l.release:
+		return l.loaderMock.Load(url, ctx)
+	case <-ctx.Done():
+		close(l.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func TestService_CoalesceRequests(t *testing.T) {
+	l := &blockingLoader{release: make(chan struct{}), cancelled: make(chan struct{})}
+	s, err := img.NewService(l, &resizerMock{}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	router := s.GetRouter()
+
+	const requests = 5
+	recorders := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		recorders[i] = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200", nil)
+		req.Header.Set("Accept", "image/webp")
+
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			router.ServeHTTP(w, req)
+		}(recorders[i])
+	}
+
+	// Giving some time for all requests to join the flight
+	time.Sleep(100 * time.Millisecond)
+	close(l.release)
+	wg.Wait()
+
+	test.Error(t,
+		test.Equal(int32(1), atomic.LoadInt32(&l.loads), "number of loads"),
+	)
+	for _, w := range recorders {
+		test.Error(t,
+			test.Equal(http.StatusOK, w.Code, "status code"),
+			test.Equal(ImgWebpOut, w.Body.String(), "resulted image"),
+		)
+	}
+}
+
+func TestService_CoalesceRequestsCancelled(t *testing.T) {
+	l := &blockingLoader{release: make(chan struct{}), cancelled: make(chan struct{})}
+	s, err := img.NewService(l, &resizerMock{}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	router := s.GetRouter()
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil).WithContext(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	cancel1()
+	select {
+	case <-l.cancelled:
+		t.Errorf("expected load to continue while there are waiting requests")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel2()
+	select {
+	case <-l.cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("expected load to be cancelled when all requests are cancelled")
+	}
+
+	wg.Wait()
+	close(l.release)
+}
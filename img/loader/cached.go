@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Cached caches source images loaded by Loader, so the same image
+// won't be loaded from the origin twice. Errors are not cached.
+type Cached struct {
+	Loader img.Loader
+	Cache  img.Cache
+	// Revalidate is a flag to check whether cached image was modified on the origin.
+	// If set to true, then a conditional request with ETag and Last-Modified of the cached
+	// image is sent to the origin, which should respond with 304 if the image wasn't modified.
+	Revalidate bool
+}
+
+func (c *Cached) Load(src string, ctx context.Context) (*img.Image, error) {
+	key := sourceCacheKey(src, ctx)
+
+	cached, ok := c.Cache.Get(key)
+	if ok && (!c.Revalidate || (len(cached.ETag) == 0 && len(cached.LastModified) == 0)) {
+		img.Log.Printf("Source image [%s] found in the cache\n", src)
+		return cached, nil
+	}
+
+	loadCtx := ctx
+	if ok {
+		loadCtx = conditionalContext(ctx, cached)
+	}
+
+	image, err := c.Loader.Load(src, loadCtx)
+	var httpErr *img.HttpError
+	if ok && errors.As(err, &httpErr) && httpErr.Code() == http.StatusNotModified {
+		img.Log.Printf("Source image [%s] found in the cache and not modified\n", src)
+		return cached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.Cache.Set(key, image)
+
+	return image, nil
+}
+
+// conditionalContext adds validators of the cached image to
+// the headers of the context.
+func conditionalContext(ctx context.Context, cached *img.Image) context.Context {
+	headers := make(http.Header)
+	if ctxHeaders, ok := img.HeaderFromContext(ctx); ok {
+		headers = ctxHeaders.Clone()
+	}
+	if len(cached.ETag) > 0 {
+		headers.Set("If-None-Match", cached.ETag)
+	}
+	if len(cached.LastModified) > 0 {
+		headers.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	return img.NewContextWithHeaders(ctx, &headers)
+}
+
+// sourceCacheKey returns the key of the source image in the cache. Headers from
+// the context are part of the key, because the origin could return different
+// images depending on them.
+func sourceCacheKey(src string, ctx context.Context) string {
+	key := "src:" + src
+
+	if headers, ok := img.HeaderFromContext(ctx); ok {
+		names := make([]string, 0, len(*headers))
+		for name := range *headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			key += "|" + name + "=" + strings.Join((*headers)[name], ",")
+		}
+	}
+
+	return key
+}
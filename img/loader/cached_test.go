@@ -0,0 +1,118 @@
+package loader_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingLoader counts calls to the wrapped loader
+type countingLoader struct {
+	img.Loader
+	calls int
+}
+
+func (l *countingLoader) Load(src string, ctx context.Context) (*img.Image, error) {
+	l.calls++
+	return l.Loader.Load(src, ctx)
+}
+
+func TestCached_Load(t *testing.T) {
+	origin := &countingLoader{Loader: &namedLoader{name: "origin"}}
+	cachedLoader := &loader.Cached{
+		Loader: origin,
+		Cache:  img.NewMemoryCache(1024),
+	}
+
+	image1, err1 := cachedLoader.Load("img.png", context.Background())
+	image2, err2 := cachedLoader.Load("img.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err1, "error"),
+		test.Nil(err2, "error"),
+		test.Equal("origin:img.png", string(image1.Data), "loaded image"),
+		test.Equal("origin:img.png", string(image2.Data), "cached image"),
+		test.Equal(1, origin.calls, "calls to the origin"),
+	)
+}
+
+func TestCached_LoadHeaders(t *testing.T) {
+	origin := &countingLoader{Loader: &namedLoader{name: "origin"}}
+	cachedLoader := &loader.Cached{
+		Loader: origin,
+		Cache:  img.NewMemoryCache(1024),
+	}
+
+	webp := &http.Header{"Accept": {"image/webp"}}
+	avif := &http.Header{"Accept": {"image/avif"}}
+
+	_, _ = cachedLoader.Load("img.png", img.NewContextWithHeaders(context.Background(), webp))
+	_, _ = cachedLoader.Load("img.png", img.NewContextWithHeaders(context.Background(), avif))
+	_, _ = cachedLoader.Load("img.png", img.NewContextWithHeaders(context.Background(), webp))
+
+	test.Error(t,
+		test.Equal(2, origin.calls, "calls to the origin"),
+	)
+}
+
+func TestCached_LoadError(t *testing.T) {
+	origin := &countingLoader{Loader: &namedLoader{name: "origin"}}
+	cachedLoader := &loader.Cached{
+		Loader: origin,
+		Cache:  img.NewMemoryCache(1024),
+	}
+
+	_, err1 := cachedLoader.Load("missing.png", context.Background())
+	_, err2 := cachedLoader.Load("missing.png", context.Background())
+
+	test.Error(t,
+		test.NotNil(err1, "error"),
+		test.NotNil(err2, "error"),
+		test.Equal(2, origin.calls, "errors are not cached"),
+	)
+}
+
+func TestCached_LoadRevalidate(t *testing.T) {
+	version := "v1"
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Get("If-None-Match"))
+		etag := `"` + version + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Add("ETag", etag)
+		w.Write([]byte(version))
+	}))
+	defer server.Close()
+
+	cachedLoader := &loader.Cached{
+		Loader:     &loader.Http{},
+		Cache:      img.NewMemoryCache(1024),
+		Revalidate: true,
+	}
+
+	image1, err1 := cachedLoader.Load(server.URL, context.Background())
+	image2, err2 := cachedLoader.Load(server.URL, context.Background())
+	version = "v2"
+	image3, err3 := cachedLoader.Load(server.URL, context.Background())
+	image4, err4 := cachedLoader.Load(server.URL, context.Background())
+
+	test.Error(t,
+		test.Nil(err1, "error"),
+		test.Nil(err2, "error"),
+		test.Nil(err3, "error"),
+		test.Nil(err4, "error"),
+		test.Equal("v1", string(image1.Data), "loaded image"),
+		test.Equal("v1", string(image2.Data), "not modified image"),
+		test.Equal("v2", string(image3.Data), "modified image"),
+		test.Equal("v2", string(image4.Data), "not modified image"),
+		test.Equal(`,"v1","v1","v2"`, strings.Join(requests, ","), "conditional requests"),
+	)
+}
@@ -0,0 +1,107 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File loads images from the local filesystem, e.g. from
+// a volume mounted to the container.
+type File struct {
+	// Root is the directory that images will be loaded from.
+	// The source of the image is resolved relative to Root and
+	// can't point to a file outside of it, including via symlinks.
+	Root string
+	// MaxSize is the maximum size of the image in bytes. 0 means no limit.
+	MaxSize int64
+}
+
+func (f *File) Load(src string, ctx context.Context) (*img.Image, error) {
+	if len(f.Root) == 0 {
+		return nil, fmt.Errorf("root directory is not set")
+	}
+
+	// Cleaning the path as an absolute one, so ".." can't go above the root
+	relPath := path.Clean("/" + strings.ReplaceAll(src, "\\", "/"))
+	fullPath, err := f.resolvePath(src, filepath.Join(f.Root, filepath.FromSlash(relPath)))
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fileError(src, err)
+	}
+	if stat.IsDir() {
+		return nil, img.NewHttpError(http.StatusNotFound, fmt.Sprintf("image [%s] not found", src))
+	}
+	if f.MaxSize > 0 && stat.Size() > f.MaxSize {
+		return nil, tooLargeError(src, f.MaxSize)
+	}
+
+	data, err := os.ReadFile(fullPath) // #nosec G304 - path is sanitised above
+	if err != nil {
+		return nil, fileError(src, err)
+	}
+
+	return &img.Image{
+		Id:           src,
+		Data:         data,
+		MimeType:     detectMimeType(fullPath, data),
+		LastModified: stat.ModTime().UTC().Format(http.TimeFormat),
+	}, nil
+}
+
+// resolvePath resolves symlinks in the path and checks that the result is still under Root.
+func (f *File) resolvePath(src string, fullPath string) (string, error) {
+	root, err := filepath.EvalSymlinks(f.Root)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve root directory [%s]: %w", f.Root, err)
+	}
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		return "", fileError(src, err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", img.NewHttpError(http.StatusNotFound, fmt.Sprintf("image [%s] not found", src))
+	}
+
+	return resolved, nil
+}
+
+func fileError(src string, err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return img.NewHttpError(http.StatusNotFound, fmt.Sprintf("image [%s] not found", src))
+	case errors.Is(err, fs.ErrPermission):
+		return img.NewHttpError(http.StatusForbidden, fmt.Sprintf("access to image [%s] is denied", src))
+	}
+
+	return err
+}
+
+// detectMimeType sniffs the content of the file and falls back to
+// the file extension for formats that can't be sniffed, e.g. AVIF or SVG.
+func detectMimeType(fileName string, data []byte) string {
+	mimeType := http.DetectContentType(data)
+	if mimeType != "application/octet-stream" && !strings.HasPrefix(mimeType, "text/") {
+		return mimeType
+	}
+
+	if extMimeType := mime.TypeByExtension(filepath.Ext(fileName)); len(extMimeType) > 0 {
+		return extMimeType
+	}
+
+	return mimeType
+}
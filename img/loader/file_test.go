@@ -0,0 +1,128 @@
+package loader_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var pngHeader = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+
+func createFileLoader(t *testing.T) *loader.File {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "products"), 0750); err != nil {
+		t.Fatalf("could not create directory: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "products", "img.png"), pngHeader, 0600); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "logo.svg"), []byte("<svg></svg>"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(root), "secret.png"), pngHeader, 0600); err != nil {
+		t.Fatalf("could not write file: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "products", "img.png"), filepath.Join(root, "inner-link.png")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(filepath.Dir(root), "secret.png"), filepath.Join(root, "secret-link.png")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+	if err := os.Symlink(filepath.Dir(root), filepath.Join(root, "parent-link")); err != nil {
+		t.Fatalf("could not create symlink: %s", err)
+	}
+
+	return &loader.File{Root: root}
+}
+
+func TestFile_Load(t *testing.T) {
+	fileLoader := createFileLoader(t)
+
+	image, err := fileLoader.Load("products/img.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("image/png", image.MimeType, "content type"),
+		test.Equal(string(pngHeader), string(image.Data), "resulted image"),
+		test.Equal("products/img.png", image.Id, "image id"),
+		test.Equal(true, len(image.LastModified) > 0, "last modified"),
+	)
+}
+
+func TestFile_LoadSymlink(t *testing.T) {
+	fileLoader := createFileLoader(t)
+
+	image, err := fileLoader.Load("inner-link.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(string(pngHeader), string(image.Data), "resulted image"),
+	)
+}
+
+func TestFile_LoadMimeTypeFromExtension(t *testing.T) {
+	fileLoader := createFileLoader(t)
+
+	image, err := fileLoader.Load("/logo.svg", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("image/svg+xml", image.MimeType, "content type"),
+	)
+}
+
+func TestFile_LoadErrors(t *testing.T) {
+	fileLoader := createFileLoader(t)
+
+	tests := []struct {
+		src  string
+		code int
+	}{
+		{"products/no-such-image.png", http.StatusNotFound},
+		{"products", http.StatusNotFound},
+		{"../secret.png", http.StatusNotFound},
+		{"products/../../secret.png", http.StatusNotFound},
+		{"..\\secret.png", http.StatusNotFound},
+		{"secret-link.png", http.StatusNotFound},
+		{"parent-link/secret.png", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		image, err := fileLoader.Load(tt.src, context.Background())
+
+		var httpErr *img.HttpError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("expected HttpError for [%s], but got [%v]", tt.src, err)
+			continue
+		}
+		test.Error(t,
+			test.Nil(image, "image"),
+			test.Equal(tt.code, httpErr.Code(), "error code"),
+		)
+	}
+}
+
+func TestFile_LoadNoRoot(t *testing.T) {
+	fileLoader := &loader.File{}
+
+	_, err := fileLoader.Load("img.png", context.Background())
+
+	test.Error(t,
+		test.NotNil(err, "error"),
+	)
+}
+
+func TestFile_LoadMaxSize(t *testing.T) {
+	fileLoader := createFileLoader(t)
+	fileLoader.MaxSize = int64(len(pngHeader) - 1)
+
+	_, err := fileLoader.Load("products/img.png", context.Background())
+
+	checkHttpErrorCode(t, err, http.StatusRequestEntityTooLarge)
+}
@@ -2,18 +2,42 @@ package loader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"syscall"
 	"time"
 )
 
 type Http struct {
 	// Headers that will be sent with each request
 	Headers http.Header
+	// BaseUrl is prepended to the source of the image if set.
+	// Could be used to hide the origin behind an alias, see Router.
+	// Sources that resolve outside of BaseUrl, e.g. "@evil.com/img.png" or "../img.png", are rejected.
+	BaseUrl string
+	// AllowedHosts is the list of hosts that images could be loaded from.
+	// The pattern that starts with "*." matches all subdomains, e.g. "*.example.com".
+	// If empty, then images could be loaded from any host.
+	AllowedHosts []string
+	// BlockPrivateNetworks is the flag to prohibit loading images from loopback,
+	// private and link-local addresses, e.g. localhost, 10.0.0.1 or 169.254.169.254.
+	// The address is checked after DNS resolution. Proxy settings are ignored when enabled.
+	BlockPrivateNetworks bool
+	// MaxSize is the maximum size of the image in bytes. 0 means no limit.
+	MaxSize int64
 }
 
 var dialer = &net.Dialer{
@@ -33,11 +57,68 @@ var client = &http.Client{
 	},
 }
 
+// cgnatNetwork is the shared address space (RFC 6598) that is not covered by net.IP.IsPrivate
+var cgnatNetwork = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// nat64Network is the well-known prefix (RFC 6052) of IPv6 addresses translated by NAT64
+// to the IPv4 address in the last 32 bits
+var nat64Network = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// sixToFourNetwork is the 6to4 prefix (RFC 3056) of IPv6 addresses with
+// the IPv4 address in the bits 16-47
+var sixToFourNetwork = &net.IPNet{IP: net.ParseIP("2002::"), Mask: net.CIDRMask(16, 128)}
+
+var privateNetworksDialer = &net.Dialer{
+	Timeout:   5 * time.Second,
+	KeepAlive: 30 * time.Second,
+	Control:   blockPrivateAddress,
+}
+
+var privateNetworksBlockingClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           privateNetworksDialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
 func (r *Http) Load(url string, ctx context.Context) (*img.Image, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := otel.Tracer("github.com/Pixboost/transformimgs/v8/img/loader").Start(ctx, "http.load",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.url", r.BaseUrl+url)),
+	)
+	defer span.End()
+
+	start := time.Now()
+	image, err := r.load(url, ctx)
+	metrics.ObserveOriginLoad("http", err, time.Since(start))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return image, err
+}
+
+func (r *Http) load(url string, ctx context.Context) (*img.Image, error) {
+	url, err := r.resolveUrl(url)
 	if err != nil {
 		return nil, err
 	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.checkHost(req); err != nil {
+		return nil, err
+	}
 	for k, v := range r.Headers {
 		for _, headerVal := range v {
 			req.Header.Add(k, headerVal)
@@ -52,23 +133,29 @@ func (r *Http) Load(url string, ctx context.Context) (*img.Image, error) {
 		}
 	}
 
-	resp, err := client.Do(req)
+	// Propagating trace context to the origin
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := r.httpClient().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, requestError(url, err)
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, img.NewHttpError(http.StatusNotModified, fmt.Sprintf("image [%s] is not modified", url))
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Expected %d but got code %d.\n Error '%s'",
-			http.StatusOK, resp.StatusCode, resp.Status)
+		return nil, responseError(url, resp.StatusCode, resp.Status)
 	}
 
 	contentType := resp.Header.Get("Content-Type")
 	contentEncoding := resp.Header.Get("Content-Encoding")
 
-	result, err := ioutil.ReadAll(resp.Body)
+	result, err := readBody(resp.Body, resp.ContentLength, r.MaxSize, url)
 	if err != nil {
 		return nil, err
 	}
@@ -78,5 +165,170 @@ func (r *Http) Load(url string, ctx context.Context) (*img.Image, error) {
 		Data:            result,
 		MimeType:        contentType,
 		ContentEncoding: contentEncoding,
+		ETag:            resp.Header.Get("ETag"),
+		LastModified:    resp.Header.Get("Last-Modified"),
 	}, nil
 }
+
+// responseError converts the status code of the origin response to HttpError.
+// 4xx codes are passed as is, so clients and CDNs could distinguish
+// a missing image from the server fault. All other codes are converted to 502 Bad Gateway.
+func responseError(src string, statusCode int, details string) error {
+	msg := fmt.Sprintf("Expected %d but got code %d when loading image [%s].\n Error '%s'", http.StatusOK, statusCode, src, details)
+	if statusCode >= 400 && statusCode < 500 {
+		return img.NewHttpError(statusCode, msg)
+	}
+
+	return img.NewHttpError(http.StatusBadGateway, msg)
+}
+
+// requestError converts errors of the origin request to HttpError. Timeouts are
+// converted to 504 Gateway Timeout and other network errors to 502 Bad Gateway.
+func requestError(src string, err error) error {
+	var httpErr *img.HttpError
+	if errors.As(err, &httpErr) || errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return img.NewHttpError(http.StatusGatewayTimeout, fmt.Sprintf("timeout while loading image [%s]: %s", src, err))
+	}
+
+	return img.NewHttpError(http.StatusBadGateway, fmt.Sprintf("error while loading image [%s]: %s", src, err))
+}
+
+// readBody reads the body of the response checking that it's not bigger than maxSize.
+// contentLength is checked upfront, so we don't need to download a big image to reject it.
+func readBody(body io.Reader, contentLength int64, maxSize int64, src string) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(body)
+	}
+
+	if contentLength > maxSize {
+		return nil, tooLargeError(src, maxSize)
+	}
+
+	result, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(result)) > maxSize {
+		return nil, tooLargeError(src, maxSize)
+	}
+
+	return result, nil
+}
+
+func tooLargeError(src string, maxSize int64) error {
+	return img.NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("image [%s] is bigger than %d bytes", src, maxSize))
+}
+
+// resolveUrl appends the source to BaseUrl and checks that the result has the same
+// scheme, user info and host as BaseUrl and the path is under the BaseUrl path.
+func (r *Http) resolveUrl(src string) (string, error) {
+	if len(r.BaseUrl) == 0 {
+		return src, nil
+	}
+
+	base, err := neturl.Parse(r.BaseUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL [%s]: %w", r.BaseUrl, err)
+	}
+	resolved, err := neturl.Parse(r.BaseUrl + src)
+	if err != nil {
+		return "", img.NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid image source [%s]", src))
+	}
+
+	basePath := base.Path
+	if !strings.HasSuffix(basePath, "/") {
+		basePath += "/"
+	}
+	if resolved.Scheme != base.Scheme ||
+		resolved.User.String() != base.User.String() ||
+		resolved.Host != base.Host ||
+		!strings.HasPrefix(path.Clean("/"+resolved.Path)+"/", basePath) {
+		return "", img.NewHttpError(http.StatusBadRequest, fmt.Sprintf("image source [%s] is outside of the origin", src))
+	}
+
+	return resolved.String(), nil
+}
+
+func (r *Http) httpClient() *http.Client {
+	c := client
+	if r.BlockPrivateNetworks {
+		c = privateNetworksBlockingClient
+	}
+	if len(r.AllowedHosts) == 0 {
+		return c
+	}
+
+	// Checking hosts of redirects as well
+	restricted := *c
+	restricted.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return r.checkHost(req)
+	}
+	return &restricted
+}
+
+func (r *Http) checkHost(req *http.Request) error {
+	if len(r.AllowedHosts) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, allowed := range r.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+
+	return img.NewHttpError(http.StatusForbidden, fmt.Sprintf("loading images from [%s] is not allowed", host))
+}
+
+// blockPrivateAddress is called by the dialer after DNS resolution, so
+// it's not possible to bypass the check by resolving a public domain to a private address.
+func blockPrivateAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return img.NewHttpError(http.StatusForbidden, fmt.Sprintf("invalid address [%s]", address))
+	}
+
+	if isPrivateAddress(ip) || isPrivateAddress(embeddedIPv4(ip)) {
+		return img.NewHttpError(http.StatusForbidden, fmt.Sprintf("loading images from private network address [%s] is not allowed", ip))
+	}
+
+	return nil
+}
+
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		cgnatNetwork.Contains(ip)
+}
+
+// embeddedIPv4 returns the IPv4 address embedded into IPv4-mapped, NAT64 or 6to4
+// IPv6 address, so these can't be used to reach private IPv4 networks.
+// Returns the same ip for all other addresses.
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	ip16 := ip.To16()
+	if nat64Network.Contains(ip16) {
+		return net.IPv4(ip16[12], ip16[13], ip16[14], ip16[15])
+	}
+	if sixToFourNetwork.Contains(ip16) {
+		return net.IPv4(ip16[2], ip16[3], ip16[4], ip16[5])
+	}
+	return ip
+}
@@ -2,12 +2,20 @@ package loader_test
 
 import (
 	"context"
+	"errors"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/loader"
 	"github.com/dooman87/kolibri/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHttp_LoadImg(t *testing.T) {
@@ -73,6 +81,116 @@ func TestHttp_LoadImgErrorResponseStatus(t *testing.T) {
 	)
 }
 
+func TestHttp_LoadImgErrorResponseStatusCodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/not-found":
+			w.WriteHeader(http.StatusNotFound)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		expectedCode int
+	}{
+		{"/not-found", http.StatusNotFound},
+		{"/forbidden", http.StatusForbidden},
+		{"/error", http.StatusBadGateway},
+		{"/slow", http.StatusGatewayTimeout},
+	}
+
+	httpLoader := &loader.Http{}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err := httpLoader.Load(server.URL+tt.path, ctx)
+
+			checkHttpErrorCode(t, err, tt.expectedCode)
+		})
+	}
+
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+
+	_, err := httpLoader.Load(closedServer.URL, context.Background())
+
+	checkHttpErrorCode(t, err, http.StatusBadGateway)
+}
+
+func TestHttp_LoadConditional(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Add("ETag", `"v1"`)
+		w.Header().Add("Last-Modified", "Mon, 02 Jan 2023 15:04:05 GMT")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{}
+
+	image, err := httpLoader.Load(server.URL, context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal(`"v1"`, image.ETag, "ETag"),
+		test.Equal("Mon, 02 Jan 2023 15:04:05 GMT", image.LastModified, "Last-Modified"),
+	)
+
+	_, err = httpLoader.Load(server.URL, img.NewContextWithHeaders(context.Background(), &http.Header{
+		"If-None-Match": {`"v1"`},
+	}))
+
+	checkHttpErrorCode(t, err, http.StatusNotModified)
+}
+
+func TestHttp_LoadTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Header().Add("Content-Type", "image/png")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	_, err := (&loader.Http{}).Load(server.URL, ctx)
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, but got [%d]", len(spans))
+	}
+	loadSpan := spans[0]
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("http.load", loadSpan.Name, "span name"),
+		test.Equal(parent.SpanContext().SpanID(), loadSpan.Parent.SpanID(), "parent span"),
+		test.Equal(true, strings.HasPrefix(traceparent, "00-"+parent.SpanContext().TraceID().String()+"-"+loadSpan.SpanContext.SpanID().String()), "traceparent header"),
+	)
+}
+
 func TestHttp_LoadCustomGlobalHeaders(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("this-is-header") != "wow" {
@@ -162,3 +280,231 @@ func TestHttp_LoadCustomContextHeaders(t *testing.T) {
 		test.Equal("123", string(image.Data), "resulted image"),
 	)
 }
+
+func TestHttp_LoadBaseUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cms/img.png" {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.Header().Add("Content-Type", "cool/stuff")
+			w.Write([]byte("123"))
+		}
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{
+		BaseUrl: server.URL + "/cms/",
+	}
+
+	image, err := httpLoader.Load("img.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("123", string(image.Data), "resulted image"),
+	)
+}
+
+func TestHttp_LoadBaseUrlOutsideOfOrigin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "cool/stuff")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		baseUrl string
+		src     string
+	}{
+		{"User info", server.URL, "@evil.internal/img.png"},
+		{"Host suffix", server.URL, ".evil.internal/img.png"},
+		{"Parent directory", server.URL + "/cms/", "../img.png"},
+		{"Encoded parent directory", server.URL + "/cms/", "%2e%2e/img.png"},
+		{"Path prefix", server.URL + "/cms", "x/img.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpLoader := &loader.Http{
+				BaseUrl: tt.baseUrl,
+			}
+
+			image, err := httpLoader.Load(tt.src, context.Background())
+
+			var httpErr *img.HttpError
+			test.Error(t,
+				test.Nil(image, "image"),
+				test.Equal(true, errors.As(err, &httpErr), "HttpError"),
+			)
+			if httpErr != nil {
+				test.Error(t, test.Equal(http.StatusBadRequest, httpErr.Code(), "error code"))
+			}
+		})
+	}
+}
+
+func TestHttp_LoadAllowedHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "cool/stuff")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		expectedCode int
+	}{
+		{"Exact host", []string{"example.com", "127.0.0.1"}, http.StatusOK},
+		{"Not allowed host", []string{"example.com"}, http.StatusForbidden},
+		{"Wildcard", []string{"*.0.0.1"}, http.StatusOK},
+		{"Wildcard doesn't match", []string{"*.example.com"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpLoader := &loader.Http{
+				AllowedHosts: tt.allowedHosts,
+			}
+
+			_, err := httpLoader.Load(server.URL, context.Background())
+
+			checkHttpErrorCode(t, err, tt.expectedCode)
+		})
+	}
+}
+
+func TestHttp_LoadAllowedHostsRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost/img.png", http.StatusFound)
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{
+		AllowedHosts: []string{"127.0.0.1"},
+	}
+
+	_, err := httpLoader.Load(server.URL, context.Background())
+
+	checkHttpErrorCode(t, err, http.StatusForbidden)
+}
+
+func TestHttp_LoadBlockPrivateNetworks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "cool/stuff")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{
+		BlockPrivateNetworks: true,
+	}
+
+	_, err := httpLoader.Load(server.URL, context.Background())
+	checkHttpErrorCode(t, err, http.StatusForbidden)
+
+	_, err = httpLoader.Load(strings.Replace(server.URL, "127.0.0.1", "localhost", 1), context.Background())
+	checkHttpErrorCode(t, err, http.StatusForbidden)
+
+	_, err = httpLoader.Load("http://169.254.169.254/latest/meta-data/", context.Background())
+	checkHttpErrorCode(t, err, http.StatusForbidden)
+
+	embeddedAddresses := []struct {
+		name string
+		url  string
+	}{
+		{"IPv4-mapped loopback", "http://[::ffff:127.0.0.1]/img.png"},
+		{"IPv4-mapped metadata", "http://[::ffff:169.254.169.254]/latest/meta-data/"},
+		{"NAT64 loopback", "http://[64:ff9b::127.0.0.1]/img.png"},
+		{"NAT64 private", "http://[64:ff9b::a00:1]/img.png"},
+		{"NAT64 metadata", "http://[64:ff9b::a9fe:a9fe]/latest/meta-data/"},
+		{"6to4 loopback", "http://[2002:7f00:1::1]/img.png"},
+		{"6to4 private", "http://[2002:c0a8:101::1]/img.png"},
+	}
+
+	for _, tt := range embeddedAddresses {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := httpLoader.Load(tt.url, context.Background())
+			checkHttpErrorCode(t, err, http.StatusForbidden)
+		})
+	}
+}
+
+func checkHttpErrorCode(t *testing.T, err error, expectedCode int) {
+	if expectedCode == http.StatusOK {
+		if err != nil {
+			t.Errorf("expected no error, but got [%s]", err)
+		}
+		return
+	}
+
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) {
+		t.Errorf("expected HttpError, but got [%v]", err)
+		return
+	}
+	if httpErr.Code() != expectedCode {
+		t.Errorf("expected [%d] error code, but got [%d]", expectedCode, httpErr.Code())
+	}
+}
+
+func TestHttp_LoadMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "cool/stuff")
+		if r.URL.Path == "/chunked" {
+			// Flushing before writing the body, so Content-Length is not sent
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("12345"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		maxSize      int64
+		expectedCode int
+	}{
+		{"No limit", "/", 0, http.StatusOK},
+		{"Less than limit", "/", 5, http.StatusOK},
+		{"Content-Length more than limit", "/", 4, http.StatusRequestEntityTooLarge},
+		{"Chunked less than limit", "/chunked", 5, http.StatusOK},
+		{"Chunked more than limit", "/chunked", 4, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpLoader := &loader.Http{
+				MaxSize: tt.maxSize,
+			}
+
+			image, err := httpLoader.Load(server.URL+tt.path, context.Background())
+
+			checkHttpErrorCode(t, err, tt.expectedCode)
+			if err == nil {
+				test.Error(t,
+					test.Equal("12345", string(image.Data), "resulted image"),
+				)
+			}
+		})
+	}
+}
+
+func TestHttp_LoadCancelledContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "cool/stuff")
+		w.Write([]byte("123"))
+	}))
+	defer server.Close()
+
+	httpLoader := &loader.Http{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := httpLoader.Load(server.URL, ctx)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled error, but got [%v]", err)
+	}
+}
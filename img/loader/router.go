@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Route maps sources of images to a Loader.
+//
+// A route matches either by Prefix or by Regexp. When matched by Prefix,
+// the prefix is removed from the source before passing it to the Loader,
+// so the prefix works as an alias of the origin, e.g. "products/" could
+// be an alias of the S3 bucket. When matched by Regexp, the source is passed
+// to the Loader as is.
+type Route struct {
+	// Prefix is the prefix of the source to match.
+	Prefix string
+	// Regexp is the regular expression to match the source. Used only when Prefix is empty.
+	Regexp *regexp.Regexp
+	// Loader is the loader of matched images.
+	Loader img.Loader
+	// Fallback is an optional loader that will be used when Loader
+	// couldn't find the image, i.e. returned 404 HttpError.
+	Fallback img.Loader
+}
+
+// Router is the loader that delegates loading to other loaders
+// based on the source of the image.
+type Router struct {
+	// Routes are checked in the order they defined and the first
+	// matched one will be used to load an image.
+	Routes []*Route
+	// Default is the loader that will be used if none of the routes matched.
+	// If nil then 404 error will be returned for such sources.
+	Default img.Loader
+}
+
+func (r *Router) Load(src string, ctx context.Context) (*img.Image, error) {
+	for _, route := range r.Routes {
+		if routeSrc, ok := route.match(src); ok {
+			return route.load(routeSrc, ctx)
+		}
+	}
+
+	if r.Default != nil {
+		return r.Default.Load(src, ctx)
+	}
+
+	return nil, img.NewHttpError(http.StatusNotFound, fmt.Sprintf("no origin found for image [%s]", src))
+}
+
+func (r *Route) match(src string) (string, bool) {
+	if len(r.Prefix) > 0 {
+		if strings.HasPrefix(src, r.Prefix) {
+			return strings.TrimPrefix(src, r.Prefix), true
+		}
+		return "", false
+	}
+
+	if r.Regexp != nil && r.Regexp.MatchString(src) {
+		return src, true
+	}
+
+	return "", false
+}
+
+func (r *Route) load(src string, ctx context.Context) (*img.Image, error) {
+	image, err := r.Loader.Load(src, ctx)
+	if err != nil && r.Fallback != nil && isNotFound(err) {
+		img.Log.Printf("Image [%s] not found, loading from the fallback origin\n", src)
+		return r.Fallback.Load(src, ctx)
+	}
+
+	return image, err
+}
+
+func isNotFound(err error) bool {
+	var httpErr *img.HttpError
+	return errors.As(err, &httpErr) && httpErr.Code() == http.StatusNotFound
+}
@@ -0,0 +1,119 @@
+package loader_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+// namedLoader returns an image with the name of the loader and requested source
+// or 404 error if source is "missing.png" and the loader is not a fallback one
+type namedLoader struct {
+	name       string
+	isFallback bool
+}
+
+func (l *namedLoader) Load(src string, ctx context.Context) (*img.Image, error) {
+	if src == "missing.png" && !l.isFallback {
+		return nil, img.NewHttpError(http.StatusNotFound, "not found")
+	}
+	if src == "broken.png" {
+		return nil, errors.New("broken")
+	}
+	return &img.Image{
+		Id:   src,
+		Data: []byte(l.name + ":" + src),
+	}, nil
+}
+
+func createRouter() *loader.Router {
+	return &loader.Router{
+		Routes: []*loader.Route{
+			{
+				Prefix:   "products/",
+				Loader:   &namedLoader{name: "products"},
+				Fallback: &namedLoader{name: "fallback", isFallback: true},
+			},
+			{
+				Prefix: "cms/",
+				Loader: &namedLoader{name: "cms"},
+			},
+			{
+				Regexp: regexp.MustCompile(`^https?://`),
+				Loader: &namedLoader{name: "http"},
+			},
+		},
+	}
+}
+
+func TestRouter_Load(t *testing.T) {
+	router := createRouter()
+
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{"products/img.png", "products:img.png"},
+		{"products/missing.png", "fallback:missing.png"},
+		{"cms/banner.png", "cms:banner.png"},
+		{"https://site.com/img.png", "http:https://site.com/img.png"},
+	}
+
+	for _, tt := range tests {
+		image, err := router.Load(tt.src, context.Background())
+
+		test.Error(t,
+			test.Nil(err, "error"),
+			test.Equal(tt.expected, string(image.Data), "resulted image"),
+		)
+	}
+}
+
+func TestRouter_LoadErrors(t *testing.T) {
+	router := createRouter()
+
+	tests := []struct {
+		src  string
+		code int
+	}{
+		{"cms/missing.png", http.StatusNotFound},
+		{"unknown/img.png", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		_, err := router.Load(tt.src, context.Background())
+
+		var httpErr *img.HttpError
+		if !errors.As(err, &httpErr) {
+			t.Errorf("expected HttpError for [%s], but got [%v]", tt.src, err)
+			continue
+		}
+		test.Error(t,
+			test.Equal(tt.code, httpErr.Code(), "error code"),
+		)
+	}
+
+	// Fallback is used only when image was not found
+	_, err := router.Load("products/broken.png", context.Background())
+	test.Error(t,
+		test.NotNil(err, "error"),
+		test.Equal("broken", err.Error(), "error message"),
+	)
+}
+
+func TestRouter_LoadDefault(t *testing.T) {
+	router := createRouter()
+	router.Default = &namedLoader{name: "default"}
+
+	image, err := router.Load("unknown/img.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("default:unknown/img.png", string(image.Data), "resulted image"),
+	)
+}
@@ -0,0 +1,288 @@
+package loader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 loads images from S3 compatible object storage, e.g. AWS S3, MinIO or Cloudflare R2.
+//
+// The source of the image is used as a key of the object in the bucket with Prefix prepended.
+// Requests are signed using AWS Signature Version 4.
+type S3 struct {
+	// Endpoint is the URL of S3 API, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	Endpoint string
+	// Region is the region of the bucket. Used for signing requests.
+	Region string
+	// Bucket is the name of the bucket to load images from.
+	Bucket string
+	// Prefix is prepended to the source of the image to get the key of the object.
+	Prefix string
+	// AccessKeyId is the access key. Requests won't be signed if empty.
+	AccessKeyId string
+	// SecretAccessKey is the secret key that is used to sign requests.
+	SecretAccessKey string
+	// SessionToken is the token for temporary credentials. Optional.
+	SessionToken string
+	// VirtualHostedStyle is a flag to put the bucket name to the host instead of the path.
+	VirtualHostedStyle bool
+	// MaxSize is the maximum size of the image in bytes. 0 means no limit.
+	MaxSize int64
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+const (
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat     = "20060102T150405Z"
+)
+
+// NewS3FromEnv creates a new S3 loader for the given bucket and prefix.
+// The endpoint, region and credentials are read from the standard AWS environment variables:
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL), AWS_REGION (or AWS_DEFAULT_REGION),
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+//
+// If the endpoint is not set then AWS S3 endpoint for the region will be used.
+func NewS3FromEnv(bucket string, prefix string) (*S3, error) {
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("bucket must be provided")
+	}
+
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	virtualHostedStyle := false
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+		virtualHostedStyle = true
+	}
+
+	return &S3{
+		Endpoint:           endpoint,
+		Region:             region,
+		Bucket:             bucket,
+		Prefix:             prefix,
+		AccessKeyId:        os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:       os.Getenv("AWS_SESSION_TOKEN"),
+		VirtualHostedStyle: virtualHostedStyle,
+	}, nil
+}
+
+func (s *S3) Load(src string, ctx context.Context) (*img.Image, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	objectUrl, err := s.objectUrl(src)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", objectUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, requestError(src, err)
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError(src, resp)
+	}
+
+	result, err := readBody(resp.Body, resp.ContentLength, s.MaxSize, src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &img.Image{
+		Id:              src,
+		Data:            result,
+		MimeType:        resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		ETag:            resp.Header.Get("ETag"),
+		LastModified:    resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func (s *S3) objectUrl(src string) (*url.URL, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint [%s]: %w", s.Endpoint, err)
+	}
+
+	key := s.Prefix + strings.TrimPrefix(src, "/")
+	// Endpoints and proxies could normalise the path, so dot segments could go outside of the prefix
+	for _, segment := range strings.Split(src, "/") {
+		if segment == "." || segment == ".." {
+			return nil, img.NewHttpError(http.StatusBadRequest, fmt.Sprintf("image source [%s] must not have dot segments", src))
+		}
+	}
+	objectUrl := *endpoint
+	basePath := strings.TrimSuffix(endpoint.Path, "/")
+	if s.VirtualHostedStyle {
+		objectUrl.Host = s.Bucket + "." + endpoint.Host
+	} else {
+		basePath += "/" + s.Bucket
+	}
+	objectUrl.Path = basePath + "/" + key
+	// S3 expects every character except unreserved ones to be encoded
+	// in the canonical request, so we send the path encoded the same way
+	objectUrl.RawPath = awsEscapePath(basePath) + "/" + awsEscapePath(key)
+	objectUrl.RawQuery = ""
+
+	return &objectUrl, nil
+}
+
+func (s *S3) responseError(src string, resp *http.Response) error {
+	s3Err := &s3Error{}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	_ = xml.Unmarshal(body, s3Err)
+
+	switch {
+	case s3Err.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound:
+		return img.NewHttpError(http.StatusNotFound, fmt.Sprintf("image [%s] not found", src))
+	case s3Err.Code == "AccessDenied" || resp.StatusCode == http.StatusForbidden:
+		return img.NewHttpError(http.StatusForbidden, fmt.Sprintf("access to image [%s] is denied", src))
+	}
+
+	// Other errors most likely mean that the storage is misconfigured or not available
+	return img.NewHttpError(http.StatusBadGateway, fmt.Sprintf("Expected %d but got code %d when loading image [%s].\n Error '%s: %s'",
+		http.StatusOK, resp.StatusCode, src, s3Err.Code, s3Err.Message))
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *S3) sign(req *http.Request, t time.Time) {
+	if len(s.AccessKeyId) == 0 {
+		return
+	}
+
+	amzDate := t.Format(s3TimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if len(s.SessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headerNames := []string{"host"}
+	for name := range req.Header {
+		headerNames = append(headerNames, strings.ToLower(name))
+	}
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := req.Host
+		if name == "host" {
+			if len(value) == 0 {
+				value = req.URL.Host
+			}
+		} else {
+			value = strings.Join(req.Header.Values(name), ",")
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSha256(signingKey, s.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+func awsEscape(s string) string {
+	escaped := strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	return strings.ReplaceAll(escaped, "%7E", "~")
+}
+
+func awsEscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package loader_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/loader"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// s3Fake is a stand-in for S3 API that implements GetObject for a single object.
+func s3Fake() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key-id/") ||
+			len(r.Header.Get("X-Amz-Date")) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case "/images/products/img%20name.png":
+			w.Header().Add("Content-Type", "cool/stuff")
+			_, _ = w.Write([]byte("123"))
+		case "/images/products/broken.png":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>InternalError</Code><Message>Oops</Message></Error>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+	}))
+}
+
+func createS3Loader(endpoint string) *loader.S3 {
+	return &loader.S3{
+		Endpoint:        endpoint,
+		Region:          "us-east-1",
+		Bucket:          "images",
+		Prefix:          "products/",
+		AccessKeyId:     "key-id",
+		SecretAccessKey: "secret",
+	}
+}
+
+func TestS3_Load(t *testing.T) {
+	server := s3Fake()
+	defer server.Close()
+
+	image, err := createS3Loader(server.URL).Load("img name.png", context.Background())
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("cool/stuff", image.MimeType, "content type"),
+		test.Equal("123", string(image.Data), "resulted image"),
+	)
+}
+
+func TestS3_LoadErrors(t *testing.T) {
+	server := s3Fake()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		src    string
+		loader *loader.S3
+		code   int
+	}{
+		{"NoSuchKey", "no-such-image.png", createS3Loader(server.URL), http.StatusNotFound},
+		{"AccessDenied", "img name.png", &loader.S3{Endpoint: server.URL, Bucket: "images"}, http.StatusForbidden},
+		{"Parent directory", "../other-prefix/secret.jpg", createS3Loader(server.URL), http.StatusBadRequest},
+		{"Nested parent directory", "a/../../other-prefix/secret.jpg", createS3Loader(server.URL), http.StatusBadRequest},
+		{"Current directory", "./img name.png", createS3Loader(server.URL), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.loader.Load(tt.src, context.Background())
+
+			var httpErr *img.HttpError
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("expected HttpError, but got [%v]", err)
+			}
+			test.Error(t,
+				test.Equal(tt.code, httpErr.Code(), "error code"),
+			)
+		})
+	}
+}
+
+func TestS3_LoadServerError(t *testing.T) {
+	server := s3Fake()
+	defer server.Close()
+
+	_, err := createS3Loader(server.URL).Load("broken.png", context.Background())
+
+	checkHttpErrorCode(t, err, http.StatusBadGateway)
+}
+
+func TestNewS3FromEnv(t *testing.T) {
+	t.Setenv("AWS_ENDPOINT_URL_S3", "")
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	t.Setenv("AWS_REGION", "ap-southeast-2")
+	t.Setenv("AWS_ACCESS_KEY_ID", "key-id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	s3, err := loader.NewS3FromEnv("images", "products/")
+
+	test.Error(t,
+		test.Nil(err, "error"),
+		test.Equal("https://s3.ap-southeast-2.amazonaws.com", s3.Endpoint, "endpoint"),
+		test.Equal("ap-southeast-2", s3.Region, "region"),
+		test.Equal("key-id", s3.AccessKeyId, "access key"),
+		test.Equal("secret", s3.SecretAccessKey, "secret key"),
+		test.Equal(true, s3.VirtualHostedStyle, "virtual hosted style"),
+	)
+
+	_, err = loader.NewS3FromEnv("", "")
+	test.Error(t,
+		test.NotNil(err, "error"),
+	)
+}
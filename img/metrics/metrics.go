@@ -0,0 +1,148 @@
+// Package metrics contains Prometheus metrics of the service.
+//
+// Metrics are registered in the default Prometheus registry and
+// exposed by Handler.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "transformimgs"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of requests by operation and status code.",
+	}, []string{"operation", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Duration of requests by operation.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"operation"})
+
+	cacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of lookups of transformed images in the cache by result: hit or miss.",
+	}, []string{"result"})
+
+	originLoadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "origin_load_duration_seconds",
+		Help:      "Duration of loading source images from the origin by loader and result: success or error.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"loader", "result"})
+
+	imagemagickDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "imagemagick_duration_seconds",
+		Help:      "Duration of ImageMagick convert command by output format.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"format"})
+
+	queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_length",
+		Help:      "Number of operations waiting in the queue.",
+	}, []string{"queue"})
+
+	queueBudgetUsed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_budget_used",
+		Help:      "Total cost of operations executed from the queue at the moment.",
+	}, []string{"queue"})
+
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time that operations waited in the queue before the execution.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"queue"})
+
+	sourceBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_bytes_total",
+		Help:      "Size of transformed source images by operation.",
+	}, []string{"operation"})
+
+	outputBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_bytes_total",
+		Help:      "Size of transformed images by operation.",
+	}, []string{"operation"})
+
+	savingsRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "savings_ratio",
+		Help:      "Ratio of bytes saved by transformations, e.g. 0.7 if the transformed image is 30% of the source.",
+		Buckets:   prometheus.LinearBuckets(0, 0.1, 11),
+	}, []string{"operation"})
+)
+
+// Handler returns HTTP handler that exposes metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records the request to the service.
+func ObserveRequest(operation string, code int, duration time.Duration) {
+	requestsTotal.WithLabelValues(operation, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// ObserveCache records the lookup of the transformed image in the cache.
+func ObserveCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequestsTotal.WithLabelValues(result).Inc()
+}
+
+// ObserveOriginLoad records loading of the source image from the origin.
+func ObserveOriginLoad(loader string, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	originLoadDuration.WithLabelValues(loader, result).Observe(duration.Seconds())
+}
+
+// ObserveImageMagick records execution of ImageMagick convert command.
+// format is the MIME type of the output image or empty if the format of the source is used.
+func ObserveImageMagick(format string, duration time.Duration) {
+	if len(format) == 0 {
+		format = "source"
+	}
+	imagemagickDuration.WithLabelValues(format).Observe(duration.Seconds())
+}
+
+// SetQueueState records the number of operations waiting in the queue and
+// the total cost of operations that are executed.
+func SetQueueState(queue string, length int, budgetUsed int) {
+	queueLength.WithLabelValues(queue).Set(float64(length))
+	queueBudgetUsed.WithLabelValues(queue).Set(float64(budgetUsed))
+}
+
+// ObserveQueueWait records the time that the operation waited in the queue.
+func ObserveQueueWait(queue string, duration time.Duration) {
+	queueWait.WithLabelValues(queue).Observe(duration.Seconds())
+}
+
+// ObserveTransformation records the size of the source and transformed images.
+func ObserveTransformation(operation string, sourceBytes int, outputBytes int) {
+	sourceBytesTotal.WithLabelValues(operation).Add(float64(sourceBytes))
+	outputBytesTotal.WithLabelValues(operation).Add(float64(outputBytes))
+	if sourceBytes > 0 {
+		savingsRatio.WithLabelValues(operation).Observe(1 - float64(outputBytes)/float64(sourceBytes))
+	}
+}
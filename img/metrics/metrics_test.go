@@ -0,0 +1,53 @@
+package metrics_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from metrics handler, but got [%d]", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	metrics.ObserveRequest("resize", http.StatusNotFound, 10*time.Millisecond)
+	metrics.ObserveCache(true)
+	metrics.ObserveOriginLoad("http", errors.New("error"), time.Second)
+	metrics.ObserveImageMagick("image/avif", time.Second)
+	metrics.ObserveImageMagick("", time.Second)
+	metrics.SetQueueState("test", 3, 8)
+	metrics.ObserveQueueWait("test", time.Millisecond)
+	metrics.ObserveTransformation("resize", 100, 30)
+
+	body := scrape(t)
+
+	expected := []string{
+		`transformimgs_requests_total{code="404",operation="resize"} 1`,
+		`transformimgs_request_duration_seconds_count{operation="resize"} 1`,
+		`transformimgs_cache_requests_total{result="hit"} 1`,
+		`transformimgs_origin_load_duration_seconds_count{loader="http",result="error"} 1`,
+		`transformimgs_imagemagick_duration_seconds_count{format="image/avif"} 1`,
+		`transformimgs_imagemagick_duration_seconds_count{format="source"} 1`,
+		`transformimgs_queue_length{queue="test"} 3`,
+		`transformimgs_queue_budget_used{queue="test"} 8`,
+		`transformimgs_queue_wait_seconds_count{queue="test"} 1`,
+		`transformimgs_source_bytes_total{operation="resize"} 100`,
+		`transformimgs_output_bytes_total{operation="resize"} 30`,
+		`transformimgs_savings_ratio_sum{operation="resize"} 0.7`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected metric [%s] in the output", e)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package img
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// Preset is a named transformation, so clients could request /img/{imgUrl}/{preset}
+// instead of passing the parameters of the transformation.
+type Preset struct {
+	// Operation is the name of the operation: "optimise", "resize", "fit", "crop" or "asis".
+	Operation string `json:"operation" yaml:"operation"`
+	// Params are query parameters of the operation, e.g. size. They
+	// override parameters passed by the client.
+	Params map[string]string `json:"params,omitempty" yaml:"params,omitempty"`
+}
+
+// Validate checks that the operation is known and its parameters could be parsed,
+// so broken presets are rejected when they are configured rather than on each request.
+func (p *Preset) Validate() error {
+	switch p.Operation {
+	case "optimise", "asis":
+	case "resize":
+		if size, ok := p.Params["size"]; ok && (len(size) == 0 || !resizeSizeRegexp.MatchString(size)) {
+			return fmt.Errorf("size should be in format WxH, but got [%s]", size)
+		}
+	case "fit":
+		if size, ok := p.Params["size"]; ok && (len(size) == 0 || !fitSizeRegexp.MatchString(size)) {
+			return fmt.Errorf("size should be in format WxH, but got [%s]", size)
+		}
+		if gravity, ok := p.Params["gravity"]; ok && !gravities[strings.ToLower(gravity)] {
+			return fmt.Errorf("unknown gravity [%s]", gravity)
+		}
+		if focus, ok := p.Params["focus"]; ok {
+			if _, err := parseFocus(focus); err != nil {
+				return fmt.Errorf("focus should be in format x,y: %w", err)
+			}
+		}
+		if crop, ok := p.Params["crop"]; ok && !cropStrategies[strings.ToLower(crop)] {
+			return fmt.Errorf("unknown crop strategy [%s]", crop)
+		}
+		if mode, ok := p.Params["mode"]; ok && strings.ToLower(mode) != ModeCrop && strings.ToLower(mode) != ModePad {
+			return fmt.Errorf("unknown mode [%s]", mode)
+		}
+		if bg, ok := p.Params["bg"]; ok {
+			if _, err := parseBackground(bg); err != nil {
+				return fmt.Errorf("bg should be in format RRGGBB: %w", err)
+			}
+		}
+	case "crop":
+		if rect, ok := p.Params["rect"]; ok {
+			if _, err := parseCrop(rect); err != nil {
+				return fmt.Errorf("rect should be in format x,y,width,height: %w", err)
+			}
+		}
+		if size, ok := p.Params["size"]; ok && !resizeSizeRegexp.MatchString(size) {
+			return fmt.Errorf("size should be in format WxH, but got [%s]", size)
+		}
+	default:
+		return fmt.Errorf("unknown operation [%s]", p.Operation)
+	}
+
+	return nil
+}
+
+type presetKey int
+
+const presetCtxKey presetKey = 0
+
+// PresetUrl transforms the image using the preset from the path. Returns 404 if the preset doesn't exist.
+func (r *Service) PresetUrl(resp http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["preset"]
+	preset, ok := r.Presets[name]
+	if !ok {
+		http.Error(resp, fmt.Sprintf("preset [%s] is not found", name), http.StatusNotFound)
+		return
+	}
+
+	var handler http.HandlerFunc
+	switch preset.Operation {
+	case "optimise":
+		handler = r.OptimiseUrl
+	case "resize":
+		handler = r.ResizeUrl
+	case "fit":
+		handler = r.FitToSizeUrl
+	case "crop":
+		handler = r.CropUrl
+	case "asis":
+		handler = r.AsIs
+	default:
+		http.Error(resp, fmt.Sprintf("preset [%s] has unknown operation [%s]", name, preset.Operation), http.StatusInternalServerError)
+		return
+	}
+
+	// The signature is verified using the requested URL, because
+	// the URL is changed below
+	if err := r.verifySignature(req); err != nil {
+		sendError(resp, err)
+		return
+	}
+
+	presetReq := req.WithContext(context.WithValue(req.Context(), presetCtxKey, name))
+	presetUrl := *req.URL
+	query := presetUrl.Query()
+	for param, value := range preset.Params {
+		query.Set(param, value)
+	}
+	presetUrl.RawQuery = query.Encode()
+	presetReq.URL = &presetUrl
+
+	handler(resp, presetReq)
+}
+
+// isPreset returns true if the request is transformed using the preset.
+func isPreset(req *http.Request) bool {
+	_, ok := req.Context().Value(presetCtxKey).(string)
+	return ok
+}
@@ -0,0 +1,116 @@
+package img_test
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestService_Presets(t *testing.T) {
+	s := createService(t)
+	s.Presets = map[string]*img.Preset{
+		"thumbnail": {Operation: "fit", Params: map[string]string{"size": "300x200"}},
+		"original":  {Operation: "asis"},
+		"broken":    {Operation: "unknown"},
+	}
+
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumbnail",
+			ExpectedCode: http.StatusOK,
+			Description:  "Fit preset",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "result image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumbnail?size=3000x2000",
+			ExpectedCode: http.StatusOK,
+			Description:  "Preset params override query",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/original",
+			ExpectedCode: http.StatusOK,
+			Description:  "Asis preset",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/unknown",
+			ExpectedCode: http.StatusNotFound,
+			Description:  "Unknown preset",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/broken",
+			ExpectedCode: http.StatusInternalServerError,
+			Description:  "Unknown operation",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_PresetsSignature(t *testing.T) {
+	signer, _ := img.NewSigner("secret")
+	s := createService(t)
+	s.Signer = signer
+	s.Presets = map[string]*img.Preset{
+		"thumbnail": {Operation: "fit", Params: map[string]string{"size": "300x200"}},
+	}
+	signed, _ := signer.Sign("http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumbnail")
+
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          signed,
+			ExpectedCode: http.StatusOK,
+			Description:  "Signed preset",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/thumbnail",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Not signed preset",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestPreset_Validate(t *testing.T) {
+	tests := []struct {
+		preset *img.Preset
+		valid  bool
+	}{
+		{&img.Preset{Operation: "optimise"}, true},
+		{&img.Preset{Operation: "asis"}, true},
+		{&img.Preset{Operation: "resize", Params: map[string]string{"size": "300"}}, true},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "gravity": "North", "mode": "pad", "bg": "ffffff"}}, true},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "focus": "50%,50%", "crop": "smart"}}, true},
+		{&img.Preset{Operation: "crop", Params: map[string]string{"rect": "10,20,300,200", "size": "100"}}, true},
+		{&img.Preset{Operation: "unknown"}, false},
+		{&img.Preset{}, false},
+		{&img.Preset{Operation: "resize", Params: map[string]string{"size": "big"}}, false},
+		{&img.Preset{Operation: "resize", Params: map[string]string{"size": ""}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300"}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "gravity": "up"}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "mode": "stretch"}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "focus": "center"}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "crop": "faces"}}, false},
+		{&img.Preset{Operation: "fit", Params: map[string]string{"size": "300x200", "mode": "pad", "bg": "red"}}, false},
+		{&img.Preset{Operation: "crop", Params: map[string]string{"rect": "10,20"}}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.preset.Validate()
+		if tt.valid != (err == nil) {
+			t.Errorf("expected preset %+v to be valid [%t], but got error [%v]", tt.preset, tt.valid, err)
+		}
+	}
+}
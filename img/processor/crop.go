@@ -0,0 +1,22 @@
+package processor
+
+import (
+	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+	"image"
+)
+
+// CropStrategy chooses the part of the image that is kept when FitToSize crops the image.
+// Strategies are registered in ImageMagick.CropStrategies by the name used in img.ResizeConfig.Crop.
+type CropStrategy interface {
+	// Crop returns the rectangle of the image with the aspect ratio of width/height
+	// that should be kept. The image is downscaled before passing to the strategy.
+	Crop(im image.Image, width int, height int) image.Rectangle
+}
+
+// SmartCrop is the content-aware CropStrategy that keeps the most salient part of the image
+// using edge density, skin tones and entropy. It's deterministic and doesn't require GPU.
+type SmartCrop struct{}
+
+func (s SmartCrop) Crop(im image.Image, width int, height int) image.Rectangle {
+	return internal.SmartCrop(im, width, height)
+}
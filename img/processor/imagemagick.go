@@ -2,13 +2,25 @@ package processor
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
 	"github.com/Pixboost/transformimgs/v8/img/processor/internal"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"image/png"
 	"io"
+	"math"
+	"net/http"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ImageMagick struct {
@@ -18,16 +30,63 @@ type ImageMagick struct {
 	// Argument name and value should be in separate array elements.
 	AdditionalArgs []string
 	// GetAdditionalArgs could return additional arguments for ImageMagick "convert" command.
-	// "op" is the name of the operation: "optimise", "resize" or "fit".
+	// "op" is the name of the operation: "optimise", "resize", "fit" or "crop".
 	// Some fields in the target info might not be filled, so you need to check on them!
 	// Argument name and value should be in a separate array elements.
 	GetAdditionalArgs func(op string, image []byte, source *img.Info, target *img.Info) []string
+	// MaxPixels is the maximum number of pixels (width * height) of the source image.
+	// Bigger images are rejected with 422 error to protect from decompression bombs. 0 means no limit.
+	MaxPixels int
+	// Limits are ImageMagick resource limits that will be passed to "convert" and "identify" commands.
+	Limits Limits
+	// CropStrategies are strategies of FitToSize by the name used in img.ResizeConfig.Crop.
+	CropStrategies map[string]CropStrategy
+}
+
+// Limits are ImageMagick resource limits, see https://imagemagick.org/script/command-line-options.php#limit
+// Empty values are not passed to ImageMagick, so the default limits are used.
+type Limits struct {
+	// Memory is the maximum amount of memory to allocate for the pixel cache, e.g. "256MiB".
+	Memory string
+	// Map is the maximum amount of memory map to allocate for the pixel cache, e.g. "512MiB".
+	Map string
+	// Disk is the maximum amount of disk space permitted for use by the pixel cache, e.g. "1GiB".
+	Disk string
+	// Time is the maximum elapsed time in seconds for the command to run.
+	Time int
+}
+
+func (l *Limits) args() []string {
+	var args []string
+	if len(l.Memory) > 0 {
+		args = append(args, "-limit", "memory", l.Memory)
+	}
+	if len(l.Map) > 0 {
+		args = append(args, "-limit", "map", l.Map)
+	}
+	if len(l.Disk) > 0 {
+		args = append(args, "-limit", "disk", l.Disk)
+	}
+	if l.Time > 0 {
+		args = append(args, "-limit", "time", strconv.Itoa(l.Time))
+	}
+	return args
 }
 
 var beforeResizeConvertOpts = []string{
 	"-auto-orient", // changing orientation before resize, so result width and height is correct
 }
 
+// cropAnalysisOpts downscale the image analysed by crop strategies, so the analysis is fast
+var cropAnalysisOpts = []string{
+	"-thumbnail", "256x256>",
+	"-colorspace", "sRGB",
+	"-background", "white",
+	"-alpha", "remove",
+	"-alpha", "off",
+	"-depth", "8",
+}
+
 var convertOpts = []string{
 	"-dither", "None",
 	"-define", "jpeg:fancy-upsampling=off",
@@ -42,8 +101,17 @@ var convertOpts = []string{
 	"+profile", "!icc,*",
 }
 
-var cutToFitOpts = []string{
-	"-gravity", "center",
+// imGravities maps gravities of FitToSize to ImageMagick gravities
+var imGravities = map[string]string{
+	img.GravityCenter:    "Center",
+	img.GravityNorth:     "North",
+	img.GravityNorthEast: "NorthEast",
+	img.GravityEast:      "East",
+	img.GravitySouthEast: "SouthEast",
+	img.GravitySouth:     "South",
+	img.GravitySouthWest: "SouthWest",
+	img.GravityWest:      "West",
+	img.GravityNorthWest: "NorthWest",
 }
 
 // Debug is a flag for logging.
@@ -99,6 +167,9 @@ func NewImageMagick(im string, idi string) (*ImageMagick, error) {
 		convertCmd:     im,
 		identifyCmd:    idi,
 		AdditionalArgs: []string{},
+		CropStrategies: map[string]CropStrategy{
+			img.CropSmart: SmartCrop{},
+		},
 	}, nil
 }
 
@@ -107,7 +178,7 @@ func NewImageMagick(im string, idi string) (*ImageMagick, error) {
 // Format of the size argument is WIDTHxHEIGHT with any of the dimension could be dropped, e.g. 300, x200, 300x200.
 func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, error) {
 	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+	source, err := p.sourceInfo(config)
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +192,7 @@ func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, erro
 	target := &img.Info{
 		Opaque: source.Opaque,
 	}
-	err = internal.CalculateTargetSizeForResize(source, target, targetSize)
+	err = internal.CalculateTargetSizeForResize(source, target, targetSize, config.Orientation.Rotate)
 	if err != nil {
 		img.Log.Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
 	}
@@ -131,17 +202,21 @@ func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, erro
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
 	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, orientationOpts(config.Orientation)...)
 	args = append(args, "-resize", targetSize)
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	qualityOpts := getQualityOptions(source, config, mimeType)
+	recordDecisions(config, source, mimeType, qualityOpts)
+	args = append(args, qualityOpts...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
 		args = append(args, p.GetAdditionalArgs("resize", srcData, source, target)...)
 	}
 	args = append(args, convertOpts...)
+	args = append(args, overlayOpts(config.Overlay, target)...)
 	args = append(args, getConvertFormatOptions(source)...)
 	args = append(args, outputFormatArg) //Output
 
-	outputImageData, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
+	outputImageData, err := p.execImagemagick(transformationContext(config), bytes.NewReader(srcData), args, config.Src.Id, mimeType, overlayFiles(config.Overlay)...)
 	if err != nil {
 		return nil, err
 	}
@@ -155,10 +230,13 @@ func (p *ImageMagick) Resize(config *img.TransformationConfig) (*img.Image, erro
 // FitToSize resizes input image to exact size with cropping everything that out of the bound.
 // It doesn't respect the aspect ratio of the original image.
 //
+// In img.ModePad the image is resized to fit inside the size preserving aspect ratio and
+// the rest is filled with the background, so nothing is cropped.
+//
 // Format of the size argument is WIDTHxHEIGHT, e.g. 300x200. Both dimensions must be included.
 func (p *ImageMagick) FitToSize(config *img.TransformationConfig) (*img.Image, error) {
 	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+	source, err := p.sourceInfo(config)
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +246,22 @@ func (p *ImageMagick) FitToSize(config *img.TransformationConfig) (*img.Image, e
 		return nil, fmt.Errorf("could not get resizeConfig")
 	}
 
+	pad := resizeConfig.Mode == img.ModePad
 	targetSize := resizeConfig.Size
 	target := &img.Info{
 		Opaque: source.Opaque,
 	}
-	err = internal.CalculateTargetSizeForFit(target, targetSize)
+	if pad {
+		var content *img.Info
+		content, err = internal.CalculateTargetSizeForPad(orientedInfo(source, config.Orientation), target, targetSize)
+		// The padding is transparent unless the background color is set
+		if err == nil && (content.Width < target.Width || content.Height < target.Height) &&
+			(len(resizeConfig.Background) == 0 || resizeConfig.Background == img.BackgroundTransparent) {
+			target.Opaque = false
+		}
+	} else {
+		err = internal.CalculateTargetSizeForFit(target, targetSize)
+	}
 	if err != nil {
 		img.Log.Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, targetSize)
 	}
@@ -182,20 +271,102 @@ func (p *ImageMagick) FitToSize(config *img.TransformationConfig) (*img.Image, e
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
 	args = append(args, beforeResizeConvertOpts...)
-	args = append(args, "-resize", targetSize+"^")
+	args = append(args, orientationOpts(config.Orientation)...)
+	if pad {
+		args = append(args, "-resize", targetSize)
+	} else {
+		args = append(args, "-resize", targetSize+"^")
+	}
 
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	qualityOpts := getQualityOptions(source, config, mimeType)
+	recordDecisions(config, source, mimeType, qualityOpts)
+	args = append(args, qualityOpts...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
 		args = append(args, p.GetAdditionalArgs("fit", srcData, source, target)...)
 	}
 	args = append(args, convertOpts...)
-	args = append(args, cutToFitOpts...)
+	if pad {
+		args = append(args, padOpts(source, mimeType, resizeConfig)...)
+	} else {
+		args = append(args, p.cutToFitOpts(config, orientedInfo(source, config.Orientation), target, resizeConfig)...)
+	}
 	args = append(args, "-extent", targetSize)
+	args = append(args, overlayOpts(config.Overlay, target)...)
 	args = append(args, getConvertFormatOptions(source)...)
 	args = append(args, outputFormatArg) //Output
 
-	outputImageData, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
+	outputImageData, err := p.execImagemagick(transformationContext(config), bytes.NewReader(srcData), args, config.Src.Id, mimeType, overlayFiles(config.Overlay)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &img.Image{
+		Data:     outputImageData,
+		MimeType: mimeType,
+	}, nil
+}
+
+// Crop crops the rectangle from input image and resizes it preserving aspect ratio
+// if the size is set. The rectangle is clipped by the bounds of the image.
+func (p *ImageMagick) Crop(config *img.TransformationConfig) (*img.Image, error) {
+	srcData := config.Src.Data
+	source, err := p.sourceInfo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cropConfig, ok := config.Config.(*img.CropConfig)
+	if !ok {
+		return nil, fmt.Errorf("could not get cropConfig")
+	}
+
+	x, y, width, height, err := internal.CalculateCropRect(orientedInfo(source, config.Orientation), cropConfig)
+	if err != nil {
+		return nil, img.NewHttpError(http.StatusBadRequest, err.Error())
+	}
+
+	cropped := &img.Info{
+		Opaque: source.Opaque,
+		Width:  width,
+		Height: height,
+	}
+	target := &img.Info{
+		Opaque: source.Opaque,
+		Width:  width,
+		Height: height,
+	}
+	if len(cropConfig.Size) > 0 {
+		target.Width, target.Height = 0, 0
+		err = internal.CalculateTargetSizeForResize(cropped, target, cropConfig.Size, 0)
+		if err != nil {
+			img.Log.Errorf("could not calculate target size for [%s], targetSize: [%s]\n", config.Src.Id, cropConfig.Size)
+		}
+	}
+	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+
+	args := make([]string, 0)
+	args = append(args, "-") //Input
+	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
+	args = append(args, beforeResizeConvertOpts...)
+	args = append(args, orientationOpts(config.Orientation)...)
+	args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", width, height, x, y), "+repage")
+	if len(cropConfig.Size) > 0 {
+		args = append(args, "-resize", cropConfig.Size)
+	}
+	qualityOpts := getQualityOptions(source, config, mimeType)
+	recordDecisions(config, source, mimeType, qualityOpts)
+	args = append(args, qualityOpts...)
+	args = append(args, p.AdditionalArgs...)
+	if p.GetAdditionalArgs != nil {
+		args = append(args, p.GetAdditionalArgs("crop", srcData, source, target)...)
+	}
+	args = append(args, convertOpts...)
+	args = append(args, overlayOpts(config.Overlay, target)...)
+	args = append(args, getConvertFormatOptions(source)...)
+	args = append(args, outputFormatArg) //Output
+
+	outputImageData, err := p.execImagemagick(transformationContext(config), bytes.NewReader(srcData), args, config.Src.Id, mimeType, overlayFiles(config.Overlay)...)
 	if err != nil {
 		return nil, err
 	}
@@ -208,40 +379,45 @@ func (p *ImageMagick) FitToSize(config *img.TransformationConfig) (*img.Image, e
 
 func (p *ImageMagick) Optimise(config *img.TransformationConfig) (*img.Image, error) {
 	srcData := config.Src.Data
-	source, err := p.LoadImageInfo(config.Src)
+	source, err := p.sourceInfo(config)
 	if err != nil {
 		return nil, err
 	}
 
 	target := &img.Info{
 		Opaque: source.Opaque,
-		Width:  source.Width,
-		Height: source.Height,
 	}
+	target.Width, target.Height = internal.RotatedSize(source, config.Orientation.Rotate)
 	outputFormatArg, mimeType := getOutputFormat(source, target, config.SupportedFormats)
 
 	args := make([]string, 0)
 	args = append(args, "-") //Input
 	args = append(args, getBeforeTransformConvertFormatOptions(config, source, mimeType)...)
 	args = append(args, beforeResizeConvertOpts...)
-	args = append(args, getQualityOptions(source, config, mimeType)...)
+	args = append(args, orientationOpts(config.Orientation)...)
+	qualityOpts := getQualityOptions(source, config, mimeType)
+	recordDecisions(config, source, mimeType, qualityOpts)
+	args = append(args, qualityOpts...)
 	args = append(args, p.AdditionalArgs...)
 	if p.GetAdditionalArgs != nil {
 		args = append(args, p.GetAdditionalArgs("optimise", srcData, source, target)...)
 	}
 	args = append(args, convertOpts...)
+	args = append(args, overlayOpts(config.Overlay, target)...)
 	args = append(args, getConvertFormatOptions(source)...)
 	args = append(args, outputFormatArg) //Output
 
-	result, err := p.execImagemagick(bytes.NewReader(srcData), args, config.Src.Id)
+	result, err := p.execImagemagick(transformationContext(config), bytes.NewReader(srcData), args, config.Src.Id, mimeType, overlayFiles(config.Overlay)...)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(result) > len(srcData) {
+	// The original image doesn't have the overlay and orientation changes, so it can't be returned
+	if len(result) > len(srcData) && config.Overlay == nil && config.Orientation == (img.Orientation{}) {
 		img.Log.Printf("[%s] WARNING: Optimised size [%d] is more than original [%d], fallback to original", config.Src.Id, len(result), len(srcData))
 		result = srcData
 		mimeType = ""
+		recordDecisions(config, source, mimeType, nil)
 	}
 
 	return &img.Image{
@@ -250,53 +426,160 @@ func (p *ImageMagick) Optimise(config *img.TransformationConfig) (*img.Image, er
 	}, nil
 }
 
-func (p *ImageMagick) execImagemagick(in *bytes.Reader, args []string, imgId string) ([]byte, error) {
+// EstimateCost estimates the cost of the transformation using the size of the source
+// and target images and the output format. The information about the source image
+// is stored in config.SrcInfo, so it won't be loaded again during the transformation.
+func (p *ImageMagick) EstimateCost(config *img.TransformationConfig) (int, error) {
+	source, err := p.sourceInfo(config)
+	if err != nil {
+		return 0, err
+	}
+	config.SrcInfo = source
+
+	target := &img.Info{
+		Opaque: source.Opaque,
+	}
+	target.Width, target.Height = internal.RotatedSize(source, config.Orientation.Rotate)
+	switch c := config.Config.(type) {
+	case *img.ResizeConfig:
+		target.Width, target.Height = 0, 0
+		if c.Mode == img.ModePad {
+			_, _ = internal.CalculateTargetSizeForPad(orientedInfo(source, config.Orientation), target, c.Size)
+		} else {
+			// Fit is estimated as resize, because the number of pixels is close enough
+			_ = internal.CalculateTargetSizeForResize(source, target, c.Size, config.Orientation.Rotate)
+		}
+	case *img.CropConfig:
+		if _, _, width, height, err := internal.CalculateCropRect(orientedInfo(source, config.Orientation), c); err == nil {
+			target.Width, target.Height = width, height
+			if len(c.Size) > 0 {
+				cropped := &img.Info{Width: width, Height: height}
+				target.Width, target.Height = 0, 0
+				_ = internal.CalculateTargetSizeForResize(cropped, target, c.Size, 0)
+			}
+		}
+	}
+	_, mimeType := getOutputFormat(source, target, config.SupportedFormats)
+
+	return internal.EstimateCost(source, target, mimeType), nil
+}
+
+// execImagemagick runs "convert" command with the image passed to stdin. Files are
+// passed to the command as file descriptors starting from 3, e.g. "fd:3" is the first file.
+func (p *ImageMagick) execImagemagick(ctx context.Context, in *bytes.Reader, args []string, imgId string, outputMimeType string, files ...[]byte) ([]byte, error) {
+	ctx, span := tracer().Start(ctx, "convert", trace.WithAttributes(
+		attribute.String("image.output_mime_type", outputMimeType),
+		attribute.StringSlice("convert.args", args),
+	))
+	defer span.End()
+
 	var out, cmderr bytes.Buffer
-	cmd := exec.Command(p.convertCmd) // #nosec G204 - sanitizing before assigning
+	cmd := exec.CommandContext(ctx, p.convertCmd) // #nosec G204 - sanitizing before assigning
 
+	cmd.Args = append(cmd.Args, p.Limits.args()...)
 	cmd.Args = append(cmd.Args, args...)
 
 	cmd.Stdin = in
 	cmd.Stdout = &out
 	cmd.Stderr = &cmderr
 
+	for _, data := range files {
+		fileReader, fileWriter, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		// Closing the reader after the command is finished, so the writer
+		// won't be blocked if the command didn't read the whole file
+		defer fileReader.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, fileReader)
+
+		go func(data []byte) {
+			_, _ = fileWriter.Write(data)
+			_ = fileWriter.Close()
+		}(data)
+	}
+
 	if Debug {
 		img.Log.Printf("[%s] Running resize command, args '%v'\n", imgId, cmd.Args)
 	}
+	start := time.Now()
 	err := cmd.Run()
+	metrics.ObserveImageMagick(outputMimeType, time.Since(start))
+	img.StatsFromContext(ctx).AddTiming("convert", time.Since(start))
 	if err != nil {
 		img.Log.Printf("[%s] Error executing convert command: %s\n", imgId, err.Error())
 		img.Log.Printf("[%s] ERROR: %s\n", imgId, cmderr.String())
-		return nil, fmt.Errorf("Error executing convert command: %w\nStderr: [%s]", err, strings.TrimSpace(cmderr.String()))
+		err = fmt.Errorf("Error executing convert command: %w\nStderr: [%s]", err, strings.TrimSpace(cmderr.String()))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "convert command failed")
+		return nil, err
 	}
+	span.SetAttributes(attribute.Int("image.output_size", out.Len()))
 
 	return out.Bytes(), nil
 }
 
-func (p *ImageMagick) execIllustration(in io.Reader) bool {
+func (p *ImageMagick) execIllustration(ctx context.Context, in io.Reader) bool {
+	ctx, span := tracer().Start(ctx, "illustration")
+	defer span.End()
+
 	var out, cmderr bytes.Buffer
-	cmd := exec.Command("illustration")
+	cmd := exec.CommandContext(ctx, "illustration")
 
 	cmd.Stdin = in
 	cmd.Stdout = &out
 	cmd.Stderr = &cmderr
 
+	start := time.Now()
 	err := cmd.Run()
+	img.StatsFromContext(ctx).AddTiming("illustration", time.Since(start))
 	if err != nil {
 		img.Log.Printf("Error executing illustration command: %s\n", err.Error())
 		img.Log.Printf("ERROR: %s\n", cmderr.String())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "illustration command failed")
 		return false
 	}
 
-	return string(out.Bytes()) == "true"
+	illustration := string(out.Bytes()) == "true"
+	span.SetAttributes(attribute.Bool("image.illustration", illustration))
+
+	return illustration
 }
 
 func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
+	return p.loadImageInfo(context.Background(), src)
+}
+
+func (p *ImageMagick) loadImageInfo(ctx context.Context, src *img.Image) (*img.Info, error) {
+	ctx, span := tracer().Start(ctx, "identify", trace.WithAttributes(attribute.Int("image.size", len(src.Data))))
+	defer span.End()
+
+	info, err := p.identify(ctx, src)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "identify failed")
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.String("image.format", info.Format),
+		attribute.Int("image.width", info.Width),
+		attribute.Int("image.height", info.Height),
+		attribute.Int("image.quality", info.Quality),
+		attribute.Bool("image.opaque", info.Opaque),
+		attribute.Bool("image.illustration", info.Illustration),
+	)
+
+	return info, nil
+}
+
+func (p *ImageMagick) identify(ctx context.Context, src *img.Image) (*img.Info, error) {
 	var out, cmderr bytes.Buffer
 	imgId := src.Id
 	in := bytes.NewReader(src.Data)
-	cmd := exec.Command(p.identifyCmd) // #nosec G204 - sanitizing before assigning
-	cmd.Args = append(cmd.Args, "-format", "%m %Q %[opaque] %w %h", "-")
+	cmd := exec.CommandContext(ctx, p.identifyCmd) // #nosec G204 - sanitizing before assigning
+	cmd.Args = append(cmd.Args, p.Limits.args()...)
+	cmd.Args = append(cmd.Args, "-format", "%m %Q %[opaque] %[orientation] %w %h", "-")
 
 	cmd.Stdin = in
 	cmd.Stdout = &out
@@ -305,7 +588,9 @@ func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
 	if Debug {
 		img.Log.Printf("[%s] Running identify command, args '%v'\n", imgId, cmd.Args)
 	}
+	start := time.Now()
 	err := cmd.Run()
+	img.StatsFromContext(ctx).AddTiming("identify", time.Since(start))
 	if err != nil {
 		img.Log.Printf("[%s] Error executing identify command: %s\n", err.Error(), imgId)
 		img.Log.Printf("[%s] ERROR: %s\n", cmderr.String(), imgId)
@@ -316,15 +601,27 @@ func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
 		Size:         in.Size(),
 		Illustration: false,
 	}
-	_, err = fmt.Sscanf(out.String(), "%s %d %t %d %d", &imageInfo.Format, &imageInfo.Quality, &imageInfo.Opaque, &imageInfo.Width, &imageInfo.Height)
+	var orientation string
+	_, err = fmt.Sscanf(out.String(), "%s %d %t %s %d %d", &imageInfo.Format, &imageInfo.Quality, &imageInfo.Opaque, &orientation, &imageInfo.Width, &imageInfo.Height)
 	if err != nil {
 		return nil, err
 	}
+	// Images are auto oriented before transformations, so width and height
+	// are swapped for orientations 5-8 that rotate the image by 90 or 270 degrees.
+	switch orientation {
+	case "LeftTop", "RightTop", "RightBottom", "LeftBottom":
+		imageInfo.Width, imageInfo.Height = imageInfo.Height, imageInfo.Width
+	}
+
+	if p.MaxPixels > 0 && imageInfo.Width*imageInfo.Height > p.MaxPixels {
+		return nil, img.NewHttpError(http.StatusUnprocessableEntity,
+			fmt.Sprintf("image [%s] is %dx%d which is more than %d pixels", imgId, imageInfo.Width, imageInfo.Height, p.MaxPixels))
+	}
 
 	if imageInfo.Format == "PNG" {
 		// IM outputs quality as 92 if no quality specified
 		imageInfo.Quality = 100
-		imageInfo.Illustration, err = p.isIllustration(src)
+		imageInfo.Illustration, err = p.isIllustration(ctx, src)
 		if err != nil {
 			return nil, err
 		}
@@ -342,7 +639,7 @@ func (p *ImageMagick) LoadImageInfo(src *img.Image) (*img.Info, error) {
 // to the next generation format.
 //
 // The initial idea is from here: https://legacy.imagemagick.org/Usage/compare/#type_reallife
-func (p *ImageMagick) isIllustration(src *img.Image) (bool, error) {
+func (p *ImageMagick) isIllustration(ctx context.Context, src *img.Image) (bool, error) {
 	// Assume everything less than 20Kb is a logo
 	if len(src.Data) < 20*1024 {
 		return true, nil
@@ -353,7 +650,230 @@ func (p *ImageMagick) isIllustration(src *img.Image) (bool, error) {
 		return false, nil
 	}
 
-	return p.execIllustration(bytes.NewBuffer(src.Data)), nil
+	return p.execIllustration(ctx, bytes.NewBuffer(src.Data)), nil
+}
+
+// sourceInfo returns the information about the source image loaded
+// before the transformation or loads it.
+func (p *ImageMagick) sourceInfo(config *img.TransformationConfig) (*img.Info, error) {
+	source := config.SrcInfo
+	if source == nil {
+		var err error
+		source, err = p.loadImageInfo(transformationContext(config), config.Src)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats := img.StatsFromContext(config.Context)
+	stats.SetDebug(img.DebugSourceFormat, source.Format)
+	stats.SetDebug(img.DebugSourceQuality, strconv.Itoa(source.Quality))
+	stats.SetDebug(img.DebugIllustration, strconv.FormatBool(source.Illustration))
+
+	return source, nil
+}
+
+// recordDecisions records the output format and quality chosen for the transformation,
+// so they could be returned to the client in the debug headers.
+func recordDecisions(config *img.TransformationConfig, source *img.Info, outputMimeType string, qualityOpts []string) {
+	stats := img.StatsFromContext(config.Context)
+	if stats == nil {
+		return
+	}
+
+	if len(outputMimeType) == 0 {
+		// The format of the source image is used
+		outputMimeType = "image/" + strings.ToLower(source.Format)
+	}
+	stats.SetDebug(img.DebugOutputFormat, outputMimeType)
+
+	quality := "default"
+	if len(qualityOpts) > 0 {
+		quality = strings.Join(qualityOpts, " ")
+	} else if source.Illustration {
+		quality = "lossless"
+	}
+	stats.SetDebug(img.DebugQuality, quality)
+}
+
+// cutToFitOpts returns options to cut the resized image to the target size
+// keeping the part of the image chosen by the crop strategy or set by the gravity of the config.
+func (p *ImageMagick) cutToFitOpts(config *img.TransformationConfig, source *img.Info, target *img.Info, resizeConfig *img.ResizeConfig) []string {
+	if strategy, ok := p.CropStrategies[resizeConfig.Crop]; ok {
+		analysed, err := p.cropAnalysisImage(config)
+		if err == nil {
+			bounds := analysed.Bounds()
+			rect := strategy.Crop(analysed, target.Width, target.Height)
+			focus := img.Point{
+				X:       100 * float64(rect.Min.X+rect.Max.X-2*bounds.Min.X) / 2 / float64(bounds.Dx()),
+				Y:       100 * float64(rect.Min.Y+rect.Max.Y-2*bounds.Min.Y) / 2 / float64(bounds.Dy()),
+				Percent: true,
+			}
+			return focusCropOpts(&img.Info{Width: bounds.Dx(), Height: bounds.Dy()}, target, focus)
+		}
+		img.Log.Printf("[%s] Could not analyse image for [%s] crop, fallback to center: %s\n", config.Src.Id, resizeConfig.Crop, err)
+	}
+
+	if resizeConfig.Gravity == img.GravityFocus {
+		return focusCropOpts(source, target, resizeConfig.Focus)
+	}
+
+	gravity, ok := imGravities[resizeConfig.Gravity]
+	if !ok {
+		gravity = imGravities[img.GravityCenter]
+	}
+	return []string{"-gravity", gravity}
+}
+
+// padOpts returns options to fill the padding around the resized image with the background.
+// The transparent background is used only when the output format supports it.
+func padOpts(source *img.Info, outputMimeType string, config *img.ResizeConfig) []string {
+	background := config.Background
+	if len(background) == 0 || background == img.BackgroundTransparent {
+		// Formats that we convert to support transparency, so only JPEG output doesn't
+		if len(outputMimeType) > 0 || source.Format != "JPEG" {
+			background = "none"
+		} else {
+			background = "white"
+		}
+	}
+
+	gravity, ok := imGravities[config.Gravity]
+	if !ok {
+		gravity = imGravities[img.GravityCenter]
+	}
+
+	opts := []string{"-background", background, "-gravity", gravity}
+	if background == "none" {
+		opts = append(opts, "-alpha", "set")
+	}
+	return opts
+}
+
+// overlayOpts returns options to composite the overlay passed in fd:3 on top of the
+// image. The overlay is composited on each frame of animated images.
+func overlayOpts(overlay *img.Overlay, target *img.Info) []string {
+	if overlay == nil {
+		return nil
+	}
+
+	opts := []string{"null:", "(", "fd:3"}
+	if overlay.Scale > 0 && target.Width > 0 {
+		width := int(math.Max(1, math.Round(overlay.Scale*float64(target.Width))))
+		opts = append(opts, "-resize", strconv.Itoa(width))
+	}
+	if overlay.Opacity > 0 && overlay.Opacity < 1 {
+		opts = append(opts,
+			"-alpha", "set",
+			"-channel", "A", "-evaluate", "multiply", strconv.FormatFloat(overlay.Opacity, 'f', -1, 64), "+channel",
+		)
+	}
+	opts = append(opts, ")")
+
+	gravity, ok := imGravities[overlay.Gravity]
+	if !ok {
+		gravity = imGravities[img.GravityCenter]
+	}
+	opts = append(opts,
+		"-gravity", gravity,
+		"-geometry", fmt.Sprintf("+%d+%d", overlay.Margin, overlay.Margin),
+		"-layers", "composite",
+	)
+
+	return opts
+}
+
+func overlayFiles(overlay *img.Overlay) [][]byte {
+	if overlay == nil {
+		return nil
+	}
+	return [][]byte{overlay.Image.Data}
+}
+
+// orientationOpts returns options to rotate and flip the image.
+func orientationOpts(orientation img.Orientation) []string {
+	var opts []string
+	if orientation.Rotate != 0 {
+		opts = append(opts, "-rotate", strconv.Itoa(orientation.Rotate))
+	}
+	if orientation.Flip {
+		opts = append(opts, "-flip")
+	}
+	if orientation.Flop {
+		opts = append(opts, "-flop")
+	}
+	return opts
+}
+
+// orientedInfo returns the info of the source image with swapped width and height
+// if the image is rotated by 90 or 270 degrees.
+func orientedInfo(source *img.Info, orientation img.Orientation) *img.Info {
+	oriented := *source
+	oriented.Width, oriented.Height = internal.RotatedSize(source, orientation.Rotate)
+	return &oriented
+}
+
+func focusCropOpts(source *img.Info, target *img.Info, focus img.Point) []string {
+	x, y := internal.CalculateFocusOffset(source, target, focus)
+	return []string{
+		"-crop", fmt.Sprintf("%dx%d+%d+%d", target.Width, target.Height, x, y), "+repage",
+		"-gravity", "Center",
+	}
+}
+
+// cropAnalysisImage returns the downscaled first frame of the source image
+// with applied orientation that is analysed by crop strategies.
+func (p *ImageMagick) cropAnalysisImage(config *img.TransformationConfig) (image.Image, error) {
+	ctx, span := tracer().Start(transformationContext(config), "crop-analysis")
+	defer span.End()
+
+	var out, cmderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.convertCmd) // #nosec G204 - sanitizing before assigning
+	cmd.Args = append(cmd.Args, p.Limits.args()...)
+	cmd.Args = append(cmd.Args, "-[0]")
+	cmd.Args = append(cmd.Args, beforeResizeConvertOpts...)
+	cmd.Args = append(cmd.Args, orientationOpts(config.Orientation)...)
+	cmd.Args = append(cmd.Args, cropAnalysisOpts...)
+	cmd.Args = append(cmd.Args, "png:-")
+
+	cmd.Stdin = bytes.NewReader(config.Src.Data)
+	cmd.Stdout = &out
+	cmd.Stderr = &cmderr
+
+	if Debug {
+		img.Log.Printf("[%s] Running crop analysis command, args '%v'\n", config.Src.Id, cmd.Args)
+	}
+	start := time.Now()
+	err := cmd.Run()
+	img.StatsFromContext(ctx).AddTiming("crop-analysis", time.Since(start))
+	if err != nil {
+		err = fmt.Errorf("error executing convert command: %w\nStderr: [%s]", err, strings.TrimSpace(cmderr.String()))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "crop analysis failed")
+		return nil, err
+	}
+
+	analysed, err := png.Decode(&out)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "crop analysis failed")
+		return nil, err
+	}
+
+	return analysed, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/Pixboost/transformimgs/v8/img/processor")
+}
+
+// transformationContext returns the context of the transformation, so
+// ImageMagick commands are killed when the context is cancelled.
+func transformationContext(config *img.TransformationConfig) context.Context {
+	if config.Context != nil {
+		return config.Context
+	}
+	return context.Background()
 }
 
 func getOutputFormat(src *img.Info, target *img.Info, supportedFormats []string) (string, string) {
@@ -2,10 +2,13 @@ package processor_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
 	"github.com/Pixboost/transformimgs/v8/img/processor"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -747,3 +750,370 @@ func TestOptimise_ErrorConvert(t *testing.T) {
 		t.Errorf("expected error to contain [%s], but got [%s]", expectedError, err.Error())
 	}
 }
+
+func TestImageMagick_MaxPixels(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	limitedProc, err := processor.NewImageMagick(os.ExpandEnv("${IM_HOME}/convert"), os.ExpandEnv("${IM_HOME}/identify"))
+	if err != nil {
+		t.Fatalf("Error while creating image processor: %+v", err)
+	}
+	limitedProc.MaxPixels = 400*400 - 1
+	limitedProc.Limits = processor.Limits{
+		Memory: "64MiB",
+		Map:    "128MiB",
+		Disk:   "256MiB",
+		Time:   30,
+	}
+
+	_, err = limitedProc.Optimise(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+	})
+
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected HttpError but got [%v]", err)
+	}
+	if httpErr.Code() != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d error code, but got %d", http.StatusUnprocessableEntity, httpErr.Code())
+	}
+
+	limitedProc.MaxPixels = 400 * 400
+	_, err = limitedProc.Optimise(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+	})
+	if err != nil {
+		t.Errorf("expected no error, but got [%s]", err)
+	}
+}
+
+func TestImageMagick_CancelledContext(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "medium-jpeg.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = proc.Resize(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		Config:  &img.ResizeConfig{Size: "300x300"},
+		Context: ctx,
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled error, but got [%v]", err)
+	}
+}
+
+func TestImageMagick_EstimateCost(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	estimate := func(supportedFormats []string) (int, *img.TransformationConfig) {
+		config := &img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			SupportedFormats: supportedFormats,
+		}
+		cost, err := proc.EstimateCost(config)
+		if err != nil {
+			t.Fatalf("Error while estimating cost: %+v", err)
+		}
+		return cost, config
+	}
+
+	pngCost, config := estimate(nil)
+	avifCost, _ := estimate([]string{"image/avif"})
+
+	if config.SrcInfo == nil || config.SrcInfo.Width == 0 {
+		t.Errorf("expected source info to be set, but got [%+v]", config.SrcInfo)
+	}
+	if pngCost < 1 {
+		t.Errorf("expected positive cost, but got [%d]", pngCost)
+	}
+	if avifCost <= pngCost {
+		t.Errorf("expected AVIF cost [%d] to be bigger than PNG cost [%d]", avifCost, pngCost)
+	}
+}
+
+func TestImageMagick_Stats(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	stats := &img.Stats{}
+	_, err = proc.Optimise(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		SupportedFormats: []string{"image/webp"},
+		Context:          img.NewContextWithStats(context.Background(), stats),
+	})
+	if err != nil {
+		t.Fatalf("Error while optimising image: %+v", err)
+	}
+
+	var timings []string
+	for _, timing := range stats.Timings() {
+		timings = append(timings, timing.Name)
+	}
+	// illustration command is skipped for small images
+	if len(timings) < 2 || timings[0] != "identify" || timings[len(timings)-1] != "convert" {
+		t.Errorf("expected identify and convert timings, but got %v", timings)
+	}
+	if stats.Debug(img.DebugSourceFormat) != "PNG" {
+		t.Errorf("expected source format PNG, but got [%s]", stats.Debug(img.DebugSourceFormat))
+	}
+	if len(stats.Debug(img.DebugOutputFormat)) == 0 || len(stats.Debug(img.DebugQuality)) == 0 {
+		t.Errorf("expected output format and quality to be recorded")
+	}
+}
+
+func TestImageMagick_Crop(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	tests := []struct {
+		config         *img.CropConfig
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{&img.CropConfig{X: 10, Y: 10, Width: 40, Height: 30}, 40, 30},
+		{&img.CropConfig{X: 0, Y: 0, Width: 50, Height: 50, Percent: true, Size: "20"}, 20, 0},
+	}
+
+	for _, tt := range tests {
+		resultImage, err := proc.Crop(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			Config: tt.config,
+		})
+		if err != nil {
+			t.Fatalf("Error while cropping image: %+v", err)
+		}
+
+		info, err := proc.LoadImageInfo(resultImage)
+		if err != nil {
+			t.Fatalf("Error while loading info of cropped image: %+v", err)
+		}
+		if info.Width != tt.expectedWidth || (tt.expectedHeight > 0 && info.Height != tt.expectedHeight) {
+			t.Errorf("expected cropped image %dx%d, but got %dx%d", tt.expectedWidth, tt.expectedHeight, info.Width, info.Height)
+		}
+	}
+
+	_, err = proc.Crop(&img.TransformationConfig{
+		Src: &img.Image{
+			Id:   f,
+			Data: orig,
+		},
+		Config: &img.CropConfig{X: 100000, Y: 0, Width: 10, Height: 10},
+	})
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) || httpErr.Code() != http.StatusBadRequest {
+		t.Errorf("expected bad request error, but got [%v]", err)
+	}
+}
+
+func TestImageMagick_CropExifOrientation(t *testing.T) {
+	// 40x20 image with EXIF orientation 6, so it's 20x40 after auto orientation
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "exif-orientation-6.jpg")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+	source := &img.Image{
+		Id:   f,
+		Data: orig,
+	}
+
+	sourceInfo, err := proc.LoadImageInfo(source)
+	if err != nil {
+		t.Fatalf("Error while loading image info: %+v", err)
+	}
+	if sourceInfo.Width != 20 || sourceInfo.Height != 40 {
+		t.Errorf("expected source image to be 20x40, but got %dx%d", sourceInfo.Width, sourceInfo.Height)
+	}
+
+	resultImage, err := proc.Crop(&img.TransformationConfig{
+		Src:    source,
+		Config: &img.CropConfig{X: 0, Y: 20, Width: 20, Height: 20},
+	})
+	if err != nil {
+		t.Fatalf("Error while cropping image: %+v", err)
+	}
+
+	info, err := proc.LoadImageInfo(resultImage)
+	if err != nil {
+		t.Fatalf("Error while loading info of cropped image: %+v", err)
+	}
+	if info.Width != 20 || info.Height != 20 {
+		t.Errorf("expected cropped image 20x20, but got %dx%d", info.Width, info.Height)
+	}
+}
+
+func TestImageMagick_FitGravity(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+
+	configs := []*img.ResizeConfig{
+		{Size: "50x30", Gravity: img.GravityNorthWest},
+		{Size: "50x30", Gravity: img.GravityFocus, Focus: img.Point{X: 90, Y: 90, Percent: true}},
+		{Size: "30x50", Gravity: img.GravityFocus, Focus: img.Point{X: 0, Y: 0}},
+		{Size: "50x30", Crop: img.CropSmart},
+		{Size: "30x50", Crop: img.CropSmart, Gravity: img.GravitySouth},
+		{Size: "80x30", Mode: img.ModePad},
+		{Size: "30x80", Mode: img.ModePad, Background: "#ff0000", Gravity: img.GravityNorth},
+		{Size: "30x80", Mode: img.ModePad, Background: img.BackgroundTransparent},
+	}
+
+	for _, config := range configs {
+		resultImage, err := proc.FitToSize(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			Config: config,
+		})
+		if err != nil {
+			t.Fatalf("Error while fitting image: %+v", err)
+		}
+
+		info, err := proc.LoadImageInfo(resultImage)
+		if err != nil {
+			t.Fatalf("Error while loading info of fitted image: %+v", err)
+		}
+		if fmt.Sprintf("%dx%d", info.Width, info.Height) != config.Size {
+			t.Errorf("expected image %s, but got %dx%d", config.Size, info.Width, info.Height)
+		}
+	}
+}
+
+func TestImageMagick_Overlay(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+	logoFile := fmt.Sprintf("%s/%s", "./test_files/transformations", "logo.png")
+	logo, err := ioutil.ReadFile(logoFile)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", logoFile, err)
+	}
+
+	resize := func(overlay *img.Overlay) *img.Image {
+		resultImage, err := proc.Resize(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			Config:  &img.ResizeConfig{Size: "100"},
+			Overlay: overlay,
+		})
+		if err != nil {
+			t.Fatalf("Error while resizing image: %+v", err)
+		}
+		return resultImage
+	}
+
+	withoutOverlay := resize(nil)
+	withOverlay := resize(&img.Overlay{
+		Image:   &img.Image{Id: logoFile, Data: logo},
+		Gravity: img.GravitySouthEast,
+		Margin:  5,
+		Opacity: 0.5,
+		Scale:   0.3,
+	})
+
+	info, err := proc.LoadImageInfo(withOverlay)
+	if err != nil {
+		t.Fatalf("Error while loading info of image with overlay: %+v", err)
+	}
+	if info.Width != 100 {
+		t.Errorf("expected image with overlay to have width 100, but got %d", info.Width)
+	}
+	if bytes.Equal(withoutOverlay.Data, withOverlay.Data) {
+		t.Errorf("expected overlay to be composited")
+	}
+}
+
+func TestImageMagick_Orientation(t *testing.T) {
+	f := fmt.Sprintf("%s/%s", "./test_files/transformations", "opaque-png.png")
+	orig, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Errorf("Can't read file %s: %+v", f, err)
+	}
+	source, err := proc.LoadImageInfo(&img.Image{Id: f, Data: orig})
+	if err != nil {
+		t.Fatalf("Error while loading info of image: %+v", err)
+	}
+
+	tests := []struct {
+		orientation    img.Orientation
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{img.Orientation{Rotate: 90}, source.Height, source.Width},
+		{img.Orientation{Rotate: 180, Flip: true}, source.Width, source.Height},
+		{img.Orientation{Rotate: 270, Flop: true}, source.Height, source.Width},
+	}
+
+	for _, tt := range tests {
+		resultImage, err := proc.Optimise(&img.TransformationConfig{
+			Src: &img.Image{
+				Id:   f,
+				Data: orig,
+			},
+			Orientation: tt.orientation,
+		})
+		if err != nil {
+			t.Fatalf("Error while optimising image: %+v", err)
+		}
+
+		info, err := proc.LoadImageInfo(resultImage)
+		if err != nil {
+			t.Fatalf("Error while loading info of rotated image: %+v", err)
+		}
+		if info.Width != tt.expectedWidth || info.Height != tt.expectedHeight {
+			t.Errorf("expected %+v image to be %dx%d, but got %dx%d", tt.orientation, tt.expectedWidth, tt.expectedHeight, info.Width, info.Height)
+		}
+	}
+}
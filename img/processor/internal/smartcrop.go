@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"image"
+	"math"
+)
+
+// Weights of the features in the saliency of the pixel
+const (
+	edgeWeight    = 1.0
+	skinWeight    = 1.8
+	entropyWeight = 0.5
+)
+
+const (
+	// entropyCellSize is the size of the square area around the pixel used to calculate the entropy
+	entropyCellSize = 8
+	// entropyBins is the number of luminance levels used to calculate the entropy
+	entropyBins = 16
+
+	skinThreshold = 0.8
+	skinMinLum    = 0.05
+	skinMaxLum    = 0.95
+
+	scoreTolerance = 1e-9
+)
+
+// skinColor is the normalised RGB vector of the skin tone
+var skinColor = [3]float64{0.78, 0.57, 0.44}
+
+// SmartCrop returns the biggest rectangle of the image with the aspect ratio of width/height
+// that has the most salient content. The saliency of the pixel is the weighted sum of the edge density,
+// skin tones and entropy of the area around the pixel. If some rectangles have the same saliency
+// then the closest to the center of the image is returned.
+//
+// The result depends only on the pixels of the image, so it's deterministic. The image should be
+// downscaled before the analysis, because the complexity is proportional to the number of pixels.
+func SmartCrop(im image.Image, width int, height int) image.Rectangle {
+	bounds := im.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 || width <= 0 || height <= 0 {
+		return bounds
+	}
+
+	cropWidth, cropHeight := w, int(math.Round(float64(w)*float64(height)/float64(width)))
+	if cropHeight > h {
+		cropWidth, cropHeight = int(math.Round(float64(h)*float64(width)/float64(height))), h
+	}
+	cropWidth, cropHeight = clamp(cropWidth, 1, w), clamp(cropHeight, 1, h)
+
+	sum := integral(saliency(im), w, h)
+	windowSum := func(x, y int) float64 {
+		return sum[(y+cropHeight)*(w+1)+x+cropWidth] - sum[y*(w+1)+x+cropWidth] -
+			sum[(y+cropHeight)*(w+1)+x] + sum[y*(w+1)+x]
+	}
+	centerDistance := func(x, y int) int {
+		dx, dy := 2*x+cropWidth-w, 2*y+cropHeight-h
+		return dx*dx + dy*dy
+	}
+
+	bestX, bestY := 0, 0
+	bestScore := math.Inf(-1)
+	for y := 0; y <= h-cropHeight; y++ {
+		for x := 0; x <= w-cropWidth; x++ {
+			score := windowSum(x, y)
+			// Sums are compared with the tolerance to the rounding errors of the summed-area table
+			tolerance := scoreTolerance * math.Max(1, math.Abs(score))
+			if score > bestScore+tolerance || (score > bestScore-tolerance && centerDistance(x, y) < centerDistance(bestX, bestY)) {
+				bestX, bestY, bestScore = x, y, score
+			}
+		}
+	}
+
+	return image.Rect(bestX, bestY, bestX+cropWidth, bestY+cropHeight).Add(bounds.Min)
+}
+
+// saliency returns the saliency of each pixel of the image in the row-major order.
+func saliency(im image.Image) []float64 {
+	bounds := im.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	lum := make([]float64, w*h)
+	result := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := im.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			rf, gf, bf := float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff
+
+			l := 0.2126*rf + 0.7152*gf + 0.0722*bf
+			lum[y*w+x] = l
+			result[y*w+x] = skinWeight * skin(rf, gf, bf, l)
+		}
+	}
+
+	at := func(x, y int) float64 {
+		return lum[clamp(y, 0, h-1)*w+clamp(x, 0, w-1)]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			edge := math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+			result[y*w+x] += edgeWeight * math.Min(edge, 1)
+		}
+	}
+
+	for cellY := 0; cellY < h; cellY += entropyCellSize {
+		for cellX := 0; cellX < w; cellX += entropyCellSize {
+			maxX, maxY := clamp(cellX+entropyCellSize, 0, w), clamp(cellY+entropyCellSize, 0, h)
+
+			var histogram [entropyBins]int
+			for y := cellY; y < maxY; y++ {
+				for x := cellX; x < maxX; x++ {
+					histogram[clamp(int(lum[y*w+x]*entropyBins), 0, entropyBins-1)]++
+				}
+			}
+
+			total := float64((maxX - cellX) * (maxY - cellY))
+			entropy := 0.0
+			for _, cnt := range histogram {
+				if cnt > 0 {
+					p := float64(cnt) / total
+					entropy -= p * math.Log2(p)
+				}
+			}
+			// Normalising to [0, 1]
+			entropy /= math.Log2(entropyBins)
+
+			for y := cellY; y < maxY; y++ {
+				for x := cellX; x < maxX; x++ {
+					result[y*w+x] += entropyWeight * entropy
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// skin returns how close the color is to the skin tone in the range [0, 1].
+func skin(r float64, g float64, b float64, lum float64) float64 {
+	mag := math.Sqrt(r*r + g*g + b*b)
+	if mag == 0 || lum < skinMinLum || lum > skinMaxLum {
+		return 0
+	}
+
+	rd, gd, bd := r/mag-skinColor[0], g/mag-skinColor[1], b/mag-skinColor[2]
+	similarity := 1 - math.Sqrt(rd*rd+gd*gd+bd*bd)
+	if similarity < skinThreshold {
+		return 0
+	}
+	return (similarity - skinThreshold) / (1 - skinThreshold)
+}
+
+// integral returns the summed-area table of values, so the sum of any
+// rectangle could be calculated in the constant time.
+func integral(values []float64, w int, h int) []float64 {
+	sum := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		rowSum := 0.0
+		for x := 0; x < w; x++ {
+			rowSum += values[y*w+x]
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + rowSum
+		}
+	}
+	return sum
+}
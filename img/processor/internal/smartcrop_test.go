@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func newImage(width int, height int, c color.Color) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			im.Set(x, y, c)
+		}
+	}
+	return im
+}
+
+// addChecker draws the black and white checkerboard in the rectangle
+func addChecker(im *image.RGBA, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if (x/2+y/2)%2 == 0 {
+				im.Set(x, y, color.White)
+			} else {
+				im.Set(x, y, color.Black)
+			}
+		}
+	}
+}
+
+func fill(im *image.RGBA, rect image.Rectangle, c color.Color) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			im.Set(x, y, c)
+		}
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	gray := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	skinTone := color.RGBA{R: 224, G: 172, B: 138, A: 255}
+
+	checkerRight := newImage(200, 100, gray)
+	addChecker(checkerRight, image.Rect(150, 20, 190, 60))
+
+	checkerTop := newImage(100, 200, gray)
+	addChecker(checkerTop, image.Rect(10, 5, 60, 40))
+
+	skinLeft := newImage(200, 100, gray)
+	fill(skinLeft, image.Rect(10, 30, 50, 70), skinTone)
+
+	tests := []struct {
+		name    string
+		image   image.Image
+		width   int
+		height  int
+		size    image.Point
+		salient image.Rectangle
+	}{
+		{"Flat image is cropped in the center", newImage(200, 100, gray), 100, 100, image.Pt(100, 100), image.Rect(50, 0, 150, 100)},
+		{"Edges and entropy on the right", checkerRight, 100, 100, image.Pt(100, 100), image.Rect(144, 16, 192, 64)},
+		{"Edges and entropy on the top", checkerTop, 100, 100, image.Pt(100, 100), image.Rect(0, 0, 64, 40)},
+		{"Skin tones on the left", skinLeft, 50, 50, image.Pt(100, 100), image.Rect(10, 30, 50, 70)},
+		{"Same aspect ratio", checkerRight, 400, 200, image.Pt(200, 100), image.Rect(0, 0, 200, 100)},
+		{"Wide target", checkerTop, 100, 20, image.Pt(100, 20), image.Rect(10, 8, 60, 24)},
+		{"Zero target size", checkerRight, 0, 100, image.Pt(200, 100), image.Rect(0, 0, 200, 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rect := SmartCrop(tt.image, tt.width, tt.height)
+			if rect.Size() != tt.size {
+				t.Errorf("expected size %v, but got %v", tt.size, rect.Size())
+			}
+			if !tt.salient.In(rect) {
+				t.Errorf("expected %v to contain %v", rect, tt.salient)
+			}
+			if again := SmartCrop(tt.image, tt.width, tt.height); again != rect {
+				t.Errorf("expected the same result %v, but got %v", rect, again)
+			}
+		})
+	}
+}
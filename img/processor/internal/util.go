@@ -3,6 +3,7 @@ package internal
 import (
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
+	"math"
 	"regexp"
 	"strconv"
 )
@@ -12,6 +13,14 @@ var (
 	fitRegexp    = regexp.MustCompile(`^(\d*)x(\d*)$`)
 )
 
+// encodeCostWeights are the costs of encoding into the output format
+// relative to encoding into JPEG or PNG.
+var encodeCostWeights = map[string]float64{
+	"image/avif": 8,
+	"image/jxl":  6,
+	"image/webp": 2,
+}
+
 func CalculateTargetSizeForFit(target *img.Info, targetSize string) error {
 	parsedSize := fitRegexp.FindStringSubmatch(targetSize)
 	if len(parsedSize) < 3 || len(parsedSize[1]) == 0 || len(parsedSize[2]) == 0 {
@@ -33,8 +42,12 @@ func CalculateTargetSizeForFit(target *img.Info, targetSize string) error {
 	return nil
 }
 
-func CalculateTargetSizeForResize(source *img.Info, target *img.Info, targetSize string) error {
-	if source.Width <= 0 || source.Height <= 0 {
+// CalculateTargetSizeForResize calculates the size of the target image preserving aspect ratio of the source.
+// rotate is the rotation in degrees applied to the source image before resizing, so width and height
+// of the source are swapped when it's rotated by 90 or 270 degrees.
+func CalculateTargetSizeForResize(source *img.Info, target *img.Info, targetSize string, rotate int) error {
+	sourceWidth, sourceHeight := RotatedSize(source, rotate)
+	if sourceWidth <= 0 || sourceHeight <= 0 {
 		return nil
 	}
 
@@ -58,7 +71,7 @@ func CalculateTargetSizeForResize(source *img.Info, target *img.Info, targetSize
 			return fmt.Errorf("expected target size in format [WIDTH]x[HEIGHT], but got [%s]", targetSize)
 		}
 	}
-	aspectRatio := float32(source.Width) / float32(source.Height)
+	aspectRatio := float32(sourceWidth) / float32(sourceHeight)
 	if target.Width > 0 {
 		target.Height = int(float32(target.Width) / aspectRatio)
 	} else if target.Height > 0 {
@@ -67,3 +80,123 @@ func CalculateTargetSizeForResize(source *img.Info, target *img.Info, targetSize
 
 	return nil
 }
+
+// RotatedSize returns width and height of the image rotated by the given degrees.
+func RotatedSize(info *img.Info, rotate int) (width int, height int) {
+	if rotate == 90 || rotate == 270 {
+		return info.Height, info.Width
+	}
+	return info.Width, info.Height
+}
+
+// CalculateTargetSizeForPad calculates the size of the target image that is exactly targetSize and
+// returns the size of the source image resized to fit inside the target preserving aspect ratio.
+// The rest of the target is filled with the background.
+func CalculateTargetSizeForPad(source *img.Info, target *img.Info, targetSize string) (*img.Info, error) {
+	err := CalculateTargetSizeForFit(target, targetSize)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &img.Info{
+		Width:  target.Width,
+		Height: target.Height,
+	}
+	if source.Width <= 0 || source.Height <= 0 {
+		return content, nil
+	}
+
+	scale := math.Min(float64(target.Width)/float64(source.Width), float64(target.Height)/float64(source.Height))
+	content.Width = clamp(int(math.Round(float64(source.Width)*scale)), 1, target.Width)
+	content.Height = clamp(int(math.Round(float64(source.Height)*scale)), 1, target.Height)
+
+	return content, nil
+}
+
+// CalculateCropRect returns the rectangle to crop in pixels of the source image. The rectangle
+// is clipped by the bounds of the image. Returns error if the rectangle is outside the image.
+func CalculateCropRect(source *img.Info, crop *img.CropConfig) (x int, y int, width int, height int, err error) {
+	fx, fy, fWidth, fHeight := crop.X, crop.Y, crop.Width, crop.Height
+	if crop.Percent {
+		fx = fx * float64(source.Width) / 100
+		fy = fy * float64(source.Height) / 100
+		fWidth = fWidth * float64(source.Width) / 100
+		fHeight = fHeight * float64(source.Height) / 100
+	}
+	// Limiting by the size of the image, so huge values don't overflow int
+	fx, fWidth = math.Min(fx, float64(source.Width)), math.Min(fWidth, float64(source.Width))
+	fy, fHeight = math.Min(fy, float64(source.Height)), math.Min(fHeight, float64(source.Height))
+
+	x, y = int(math.Round(fx)), int(math.Round(fy))
+	width, height = int(math.Round(fWidth)), int(math.Round(fHeight))
+	if x >= source.Width || y >= source.Height || width <= 0 || height <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("rectangle %dx%d+%d+%d is outside the image %dx%d", width, height, x, y, source.Width, source.Height)
+	}
+	if x+width > source.Width {
+		width = source.Width - x
+	}
+	if y+height > source.Height {
+		height = source.Height - y
+	}
+
+	return x, y, width, height, nil
+}
+
+// CalculateFocusOffset returns the offset of the target rectangle in the source image resized
+// to cover the target size, so the focus point is in the center of the target where possible.
+func CalculateFocusOffset(source *img.Info, target *img.Info, focus img.Point) (x int, y int) {
+	if source.Width <= 0 || source.Height <= 0 {
+		return 0, 0
+	}
+
+	fx, fy := focus.X, focus.Y
+	if focus.Percent {
+		fx = fx * float64(source.Width) / 100
+		fy = fy * float64(source.Height) / 100
+	}
+
+	scale := math.Max(float64(target.Width)/float64(source.Width), float64(target.Height)/float64(source.Height))
+	resizedWidth := int(math.Round(float64(source.Width) * scale))
+	resizedHeight := int(math.Round(float64(source.Height) * scale))
+
+	x = int(math.Round(fx*scale - float64(target.Width)/2))
+	y = int(math.Round(fy*scale - float64(target.Height)/2))
+
+	return clamp(x, 0, resizedWidth-target.Width), clamp(y, 0, resizedHeight-target.Height)
+}
+
+func clamp(v int, min int, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+// EstimateCost estimates the cost of the transformation where img.CostPerProcessor is roughly the cost of
+// decoding and encoding 1 megapixel JPEG or PNG image. Decoding cost depends on the size of
+// the source image and encoding cost depends on the size of the target image and the output format.
+func EstimateCost(source *img.Info, target *img.Info, outputMimeType string) int {
+	const megapixel = 1000 * 1000
+
+	targetPixels := target.Width * target.Height
+	if targetPixels == 0 {
+		targetPixels = source.Width * source.Height
+	}
+
+	weight, ok := encodeCostWeights[outputMimeType]
+	if !ok {
+		weight = 1
+	}
+
+	decodeCost := 0.5 * float64(source.Width*source.Height) / megapixel
+	encodeCost := 0.5 * weight * float64(targetPixels) / megapixel
+
+	cost := int(math.Ceil((decodeCost + encodeCost) * img.CostPerProcessor))
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
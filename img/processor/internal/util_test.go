@@ -93,7 +93,7 @@ func TestCalculateTargetSizeForResize(t *testing.T) {
 		err := CalculateTargetSizeForResize(&img.Info{
 			Width:  tt.sourceWidth,
 			Height: tt.sourceHeight,
-		}, target, tt.targetSize)
+		}, target, tt.targetSize, 0)
 
 		if target.Width != tt.expectedWidth {
 			t.Errorf("Test %d failed: Expected [%d] width, but got [%d]", idx, tt.expectedWidth, target.Width)
@@ -124,14 +124,160 @@ func FuzzCalculateTargetSizeForResize(f *testing.F) {
 	}
 
 	for _, tt := range tests {
-		f.Add(tt.sourceWidth, tt.sourceHeight, tt.targetSize)
+		f.Add(tt.sourceWidth, tt.sourceHeight, tt.targetSize, 0)
+		f.Add(tt.sourceWidth, tt.sourceHeight, tt.targetSize, 90)
 	}
 
-	f.Fuzz(func(t *testing.T, sourceWidth int, sourceHeight int, targetSize string) {
+	f.Fuzz(func(t *testing.T, sourceWidth int, sourceHeight int, targetSize string, rotate int) {
 		target := &img.Info{}
 		_ = CalculateTargetSizeForResize(&img.Info{
 			Width:  sourceWidth,
 			Height: sourceHeight,
-		}, target, targetSize)
+		}, target, targetSize, rotate)
 	})
 }
+
+func TestCalculateTargetSizeForResize_Rotate(t *testing.T) {
+	tests := []struct {
+		rotate         int
+		targetSize     string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{0, "400", 400, 300},
+		{90, "300", 300, 400},
+		{90, "x400", 300, 400},
+		{180, "400", 400, 300},
+		{270, "x200", 150, 200},
+	}
+
+	for idx, tt := range tests {
+		target := &img.Info{}
+		err := CalculateTargetSizeForResize(&img.Info{
+			Width:  800,
+			Height: 600,
+		}, target, tt.targetSize, tt.rotate)
+
+		if err != nil {
+			t.Errorf("Test %d failed: Expected no error, but got [%s]", idx, err)
+		}
+		if target.Width != tt.expectedWidth || target.Height != tt.expectedHeight {
+			t.Errorf("Test %d failed: Expected [%dx%d], but got [%dx%d]", idx, tt.expectedWidth, tt.expectedHeight, target.Width, target.Height)
+		}
+	}
+}
+
+func TestEstimateCost(t *testing.T) {
+	tests := []struct {
+		sourceWidth    int
+		sourceHeight   int
+		targetWidth    int
+		targetHeight   int
+		outputMimeType string
+		expectedCost   int
+	}{
+		{1000, 1000, 0, 0, "", img.CostPerProcessor},
+		{1000, 1000, 0, 0, "image/jpeg", img.CostPerProcessor},
+		{1000, 1000, 0, 0, "image/webp", 6},
+		{2000, 2000, 0, 0, "image/webp", 24},
+		{2000, 2000, 1000, 1000, "image/avif", 24},
+		{2000, 2000, 1000, 1000, "image/jxl", 20},
+		{4000, 3000, 300, 200, "image/avif", 25},
+		{300, 200, 0, 0, "image/avif", 2},
+		{100, 100, 0, 0, "", 1},
+		{0, 0, 0, 0, "image/avif", 1},
+	}
+
+	for idx, tt := range tests {
+		source := &img.Info{Width: tt.sourceWidth, Height: tt.sourceHeight}
+		target := &img.Info{Width: tt.targetWidth, Height: tt.targetHeight}
+
+		cost := EstimateCost(source, target, tt.outputMimeType)
+
+		if cost != tt.expectedCost {
+			t.Errorf("Test %d failed: Expected [%d] cost, but got [%d]", idx, tt.expectedCost, cost)
+		}
+	}
+}
+
+func TestCalculateTargetSizeForPad(t *testing.T) {
+	tests := []struct {
+		source          img.Info
+		targetSize      string
+		expectedTarget  [2]int
+		expectedContent [2]int
+		error           bool
+	}{
+		{img.Info{Width: 1000, Height: 500}, "300x300", [2]int{300, 300}, [2]int{300, 150}, false},
+		{img.Info{Width: 500, Height: 1000}, "300x300", [2]int{300, 300}, [2]int{150, 300}, false},
+		{img.Info{Width: 100, Height: 50}, "400x100", [2]int{400, 100}, [2]int{200, 100}, false},
+		{img.Info{Width: 600, Height: 400}, "300x200", [2]int{300, 200}, [2]int{300, 200}, false},
+		{img.Info{Width: 10000, Height: 1}, "300x200", [2]int{300, 200}, [2]int{300, 1}, false},
+		{img.Info{}, "300x200", [2]int{300, 200}, [2]int{300, 200}, false},
+		{img.Info{Width: 600, Height: 400}, "300", [2]int{0, 0}, [2]int{0, 0}, true},
+	}
+
+	for idx, tt := range tests {
+		target := &img.Info{}
+		content, err := CalculateTargetSizeForPad(&tt.source, target, tt.targetSize)
+		if tt.error != (err != nil) {
+			t.Errorf("Test %d: expected error [%t], but got [%v]", idx, tt.error, err)
+		}
+		if [2]int{target.Width, target.Height} != tt.expectedTarget {
+			t.Errorf("Test %d: expected target %v, but got %v", idx, tt.expectedTarget, [2]int{target.Width, target.Height})
+		}
+		if content != nil && [2]int{content.Width, content.Height} != tt.expectedContent {
+			t.Errorf("Test %d: expected content %v, but got %v", idx, tt.expectedContent, [2]int{content.Width, content.Height})
+		}
+	}
+}
+
+func TestCalculateCropRect(t *testing.T) {
+	source := &img.Info{Width: 1000, Height: 500}
+	tests := []struct {
+		crop     img.CropConfig
+		expected [4]int
+		error    bool
+	}{
+		{img.CropConfig{X: 10, Y: 20, Width: 300, Height: 200}, [4]int{10, 20, 300, 200}, false},
+		{img.CropConfig{X: 10, Y: 20, Width: 50, Height: 50, Percent: true}, [4]int{100, 100, 500, 250}, false},
+		{img.CropConfig{X: 900, Y: 400, Width: 300, Height: 200}, [4]int{900, 400, 100, 100}, false},
+		{img.CropConfig{X: 1000, Y: 0, Width: 300, Height: 200}, [4]int{}, true},
+		{img.CropConfig{X: 0, Y: 0, Width: 0.1, Height: 0.1, Percent: true}, [4]int{0, 0, 1, 1}, false},
+		{img.CropConfig{X: 1e20, Y: 0, Width: 10, Height: 10}, [4]int{}, true},
+		{img.CropConfig{X: 10, Y: 20, Width: 1e20, Height: 1e20}, [4]int{10, 20, 990, 480}, false},
+	}
+
+	for idx, tt := range tests {
+		x, y, width, height, err := CalculateCropRect(source, &tt.crop)
+		if tt.error != (err != nil) {
+			t.Errorf("Test %d: expected error [%t], but got [%v]", idx, tt.error, err)
+		}
+		if [4]int{x, y, width, height} != tt.expected {
+			t.Errorf("Test %d: expected %v, but got %v", idx, tt.expected, [4]int{x, y, width, height})
+		}
+	}
+}
+
+func TestCalculateFocusOffset(t *testing.T) {
+	source := &img.Info{Width: 1000, Height: 500}
+	tests := []struct {
+		target   img.Info
+		focus    img.Point
+		expected [2]int
+	}{
+		{img.Info{Width: 200, Height: 200}, img.Point{X: 500, Y: 250}, [2]int{100, 0}},
+		{img.Info{Width: 200, Height: 200}, img.Point{X: 0, Y: 0}, [2]int{0, 0}},
+		{img.Info{Width: 200, Height: 200}, img.Point{X: 1000, Y: 500}, [2]int{200, 0}},
+		{img.Info{Width: 200, Height: 200}, img.Point{X: 25, Y: 50, Percent: true}, [2]int{0, 0}},
+		{img.Info{Width: 200, Height: 200}, img.Point{X: 75, Y: 50, Percent: true}, [2]int{200, 0}},
+		{img.Info{Width: 500, Height: 100}, img.Point{X: 500, Y: 400}, [2]int{0, 150}},
+	}
+
+	for idx, tt := range tests {
+		x, y := CalculateFocusOffset(source, &tt.target, tt.focus)
+		if [2]int{x, y} != tt.expected {
+			t.Errorf("Test %d: expected %v, but got %v", idx, tt.expected, [2]int{x, y})
+		}
+	}
+}
@@ -1,43 +1,236 @@
 package img
 
+import (
+	"container/list"
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Queue is a pool of transformations that are executed at the same time. Each operation
+// takes its cost from the budget of the queue while executing, so there could be many
+// cheap operations or a few expensive ones executed at the same time. Operations
+// that don't fit the budget are waiting in the order they were added.
 type Queue struct {
-	ops chan *Command
+	// Name is the name of the queue used in metrics.
+	Name string
+	// Budget is the maximum total cost of operations executed at the same time.
+	// Operations that cost more than the budget are executed one at a time.
+	Budget int
+	// MaxLength is the maximum number of operations waiting in the queue.
+	// New operations are rejected with 503 error when the queue is full. 0 means no limit.
+	MaxLength int
+	// MaxWait is the maximum time that an operation could wait in the queue
+	// before the execution. Operations that waited longer are rejected with 503 error.
+	// 0 means no limit.
+	MaxWait time.Duration
+	mux     sync.Mutex
+	used    int
+	waiting *list.List
+}
+
+type queueWaiter struct {
+	cost  int
+	ready chan struct{}
 }
 
 type OpCallback func()
 
+// NewQueue creates a queue that executes one operation at a time.
 func NewQueue() *Queue {
-	q := &Queue{}
-	q.ops = make(chan *Command)
-	go q.start()
-	return q
-}
-
-func (q *Queue) start() {
-	for op := range q.ops {
-		if op.Result == nil {
-			Log.Printf("Starting transformation for [%s]", op.Config.Src.Id)
-			op.Result, op.Err = op.Transformation(op.Config)
-			Log.Printf("Finished transformation for [%s]", op.Config.Src.Id)
+	return &Queue{
+		Budget:  1,
+		waiting: list.New(),
+	}
+}
+
+// AddAndWait adds the operation to the queue and waits until it's executed.
+// Returns 503 HttpError with Retry-After header if the queue is full or the operation
+// waited in the queue longer than MaxWait. The callback is not called in this case.
+//
+// If the context of the operation is cancelled before the execution, then the operation
+// is skipped and the error of the context is returned without calling the callback.
+func (q *Queue) AddAndWait(op *Command, callback OpCallback) error {
+	cost := q.cost(op)
+
+	start := time.Now()
+	err := q.acquire(op, cost)
+	if op.Config != nil {
+		StatsFromContext(op.Config.Context).AddTiming("queue-wait", time.Since(start))
+	}
+	if err != nil {
+		return err
+	}
+	err = q.execute(op)
+	q.release(cost)
+	if err != nil {
+		return err
+	}
+
+	callback()
+
+	return nil
+}
+
+// Length returns the number of operations waiting in the queue.
+func (q *Queue) Length() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.waiting == nil {
+		return 0
+	}
+	return q.waiting.Len()
+}
+
+// execute runs the transformation of the operation. Returns the error of the context
+// if it was cancelled before the execution.
+func (q *Queue) execute(op *Command) error {
+	if op.Result == nil && op.Config.Context != nil && op.Config.Context.Err() != nil {
+		Log.Printf("Skipping transformation for [%s]: %s", op.Config.Src.Id, op.Config.Context.Err())
+		return op.Config.Context.Err()
+	} else if op.Result == nil {
+		Log.Printf("Starting transformation for [%s] with cost %d", op.Config.Src.Id, op.Cost)
+		op.Result, op.Err = op.Transformation(op.Config)
+		Log.Printf("Finished transformation for [%s]", op.Config.Src.Id)
+	}
+	return nil
+}
+
+// acquire takes the cost from the budget waiting for it if needed. Returns the error
+// of the context if it was cancelled while waiting.
+func (q *Queue) acquire(op *Command, cost int) error {
+	q.mux.Lock()
+	if q.waiting == nil {
+		q.waiting = list.New()
+	}
+	if q.waiting.Len() == 0 && q.used+cost <= q.budget() {
+		q.used += cost
+		q.updateMetrics()
+		q.mux.Unlock()
+		metrics.ObserveQueueWait(q.Name, 0)
+		return nil
+	}
+	if q.MaxLength > 0 && q.waiting.Len() >= q.MaxLength {
+		q.mux.Unlock()
+		return q.unavailableError(fmt.Sprintf("queue is full, %d operations are waiting", q.MaxLength))
+	}
+	waiter := &queueWaiter{cost: cost, ready: make(chan struct{})}
+	elem := q.waiting.PushBack(waiter)
+	q.updateMetrics()
+	q.mux.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metrics.ObserveQueueWait(q.Name, time.Since(start))
+	}()
+
+	var timeout <-chan time.Time
+	if q.MaxWait > 0 {
+		timer := time.NewTimer(q.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var done <-chan struct{}
+	if op.Config != nil && op.Config.Context != nil {
+		done = op.Config.Context.Done()
+	}
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-timeout:
+		if q.leave(elem, waiter) {
+			return nil
 		}
-		op.FinishedCond.L.Lock()
-		op.Finished = true
-		op.FinishedCond.L.Unlock()
+		return q.unavailableError(fmt.Sprintf("operation waited in the queue for more than %s", q.MaxWait))
+	case <-done:
+		if q.leave(elem, waiter) {
+			return nil
+		}
+		Log.Printf("Skipping transformation for [%s]: %s", op.Config.Src.Id, op.Config.Context.Err())
+		return op.Config.Context.Err()
+	}
+}
 
-		op.FinishedCond.Signal()
+// leave removes the waiter from the queue. Returns true if the waiter
+// has taken the budget already.
+func (q *Queue) leave(elem *list.Element, waiter *queueWaiter) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	default:
 	}
+
+	q.waiting.Remove(elem)
+	// Operations behind could fit the budget now
+	q.notify()
+	q.updateMetrics()
+	return false
+}
+
+func (q *Queue) release(cost int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.used -= cost
+	q.notify()
+	q.updateMetrics()
 }
 
-func (q *Queue) AddAndWait(op *Command, callback OpCallback) {
-	//Adding operation to the execution channel
-	q.ops <- op
+// updateMetrics must be called with the lock held.
+func (q *Queue) updateMetrics() {
+	metrics.SetQueueState(q.Name, q.waiting.Len(), q.used)
+}
 
-	//Waiting for operation to finish
-	op.FinishedCond.L.Lock()
-	for !op.Finished {
-		op.FinishedCond.Wait()
+// notify starts waiting operations in order while they fit the budget.
+// Must be called with the lock held.
+func (q *Queue) notify() {
+	for q.waiting.Len() > 0 {
+		front := q.waiting.Front()
+		waiter := front.Value.(*queueWaiter)
+		if q.used+waiter.cost > q.budget() {
+			return
+		}
+		q.used += waiter.cost
+		q.waiting.Remove(front)
+		close(waiter.ready)
 	}
-	op.FinishedCond.L.Unlock()
+}
 
-	callback()
+func (q *Queue) budget() int {
+	if q.Budget <= 0 {
+		return 1
+	}
+	return q.Budget
+}
+
+// cost returns the cost of the operation that fits the budget.
+func (q *Queue) cost(op *Command) int {
+	cost := op.Cost
+	if cost < 1 {
+		cost = 1
+	}
+	if cost > q.budget() {
+		cost = q.budget()
+	}
+	return cost
+}
+
+func (q *Queue) unavailableError(msg string) error {
+	retryAfter := 1
+	if q.MaxWait > 0 {
+		retryAfter = int(math.Ceil(q.MaxWait.Seconds()))
+	}
+
+	err := NewHttpError(http.StatusServiceUnavailable, msg)
+	err.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	return err
 }
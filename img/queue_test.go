@@ -0,0 +1,260 @@
+package img_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueue_SkipCancelled(t *testing.T) {
+	q := img.NewQueue()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	executed := false
+	op := &img.Command{
+		Transformation: func(input *img.TransformationConfig) (*img.Image, error) {
+			executed = true
+			return &img.Image{}, nil
+		},
+		Config: &img.TransformationConfig{
+			Src:     &img.Image{Id: "img.png"},
+			Context: ctx,
+		},
+	}
+
+	callbackCalled := false
+	err := q.AddAndWait(op, func() {
+		callbackCalled = true
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled error, but got [%v]", err)
+	}
+	if executed {
+		t.Errorf("expected transformation to be skipped")
+	}
+	if callbackCalled {
+		t.Errorf("expected callback to be skipped")
+	}
+}
+
+// blockingOp returns an operation that signals when it's started
+// and waits for the release channel to be closed
+func blockingOp(started chan struct{}, release chan struct{}) *img.Command {
+	return &img.Command{
+		Transformation: func(input *img.TransformationConfig) (*img.Image, error) {
+			if started != nil {
+				close(started)
+			}
+			<-release
+			return &img.Image{}, nil
+		},
+		Config: &img.TransformationConfig{
+			Src: &img.Image{Id: "img.png"},
+		},
+	}
+}
+
+func checkUnavailable(t *testing.T, err error, retryAfter string) {
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected HttpError, but got [%v]", err)
+	}
+	test.Error(t,
+		test.Equal(http.StatusServiceUnavailable, httpErr.Code(), "error code"),
+		test.Equal(retryAfter, httpErr.Header().Get("Retry-After"), "Retry-After header"),
+	)
+}
+
+func TestQueue_ZeroValue(t *testing.T) {
+	q := &img.Queue{}
+
+	test.Error(t,
+		test.Equal(0, q.Length(), "queue length"),
+	)
+}
+
+func TestQueue_MaxLength(t *testing.T) {
+	q := img.NewQueue()
+	q.MaxLength = 1
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = q.AddAndWait(blockingOp(started, release), func() {})
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		_ = q.AddAndWait(blockingOp(nil, release), func() {})
+	}()
+	for q.Length() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := q.AddAndWait(blockingOp(nil, release), func() {
+		t.Errorf("callback must not be called")
+	})
+	checkUnavailable(t, err, "1")
+
+	close(release)
+	wg.Wait()
+
+	test.Error(t,
+		test.Equal(0, q.Length(), "queue length"),
+	)
+}
+
+func TestQueue_MaxWait(t *testing.T) {
+	q := img.NewQueue()
+	q.MaxWait = 50 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = q.AddAndWait(blockingOp(started, release), func() {})
+		close(done)
+	}()
+	<-started
+
+	err := q.AddAndWait(blockingOp(nil, release), func() {
+		t.Errorf("callback must not be called")
+	})
+	checkUnavailable(t, err, "1")
+
+	close(release)
+	<-done
+
+	test.Error(t,
+		test.Equal(0, q.Length(), "queue length"),
+	)
+}
+
+func TestQueue_Budget(t *testing.T) {
+	q := img.NewQueue()
+	q.Budget = 4
+
+	release := make(chan struct{})
+	var running, maxRunning int32
+	var order []int
+	var orderMux sync.Mutex
+	op := func(id int, cost int, started chan struct{}) *img.Command {
+		return &img.Command{
+			Transformation: func(input *img.TransformationConfig) (*img.Image, error) {
+				orderMux.Lock()
+				order = append(order, id)
+				orderMux.Unlock()
+				if r := atomic.AddInt32(&running, 1); r > atomic.LoadInt32(&maxRunning) {
+					atomic.StoreInt32(&maxRunning, r)
+				}
+				if started != nil {
+					close(started)
+				}
+				<-release
+				atomic.AddInt32(&running, -1)
+				return &img.Image{}, nil
+			},
+			Config: &img.TransformationConfig{
+				Src: &img.Image{Id: "img.png"},
+			},
+			Cost: cost,
+		}
+	}
+
+	var wg sync.WaitGroup
+	add := func(op *img.Command) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = q.AddAndWait(op, func() {})
+		}()
+	}
+
+	started1 := make(chan struct{})
+	started2 := make(chan struct{})
+	add(op(1, 2, started1))
+	add(op(2, 2, started2))
+	<-started1
+	<-started2
+
+	// Expensive operation is waiting for the budget and
+	// cheap operation is waiting behind it
+	add(op(3, 10, nil))
+	for q.Length() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	add(op(4, 1, nil))
+	for q.Length() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	test.Error(t,
+		test.Equal(int32(2), atomic.LoadInt32(&maxRunning), "max running operations"),
+		test.Equal(4, len(order), "number of executed operations"),
+		test.Equal(3, order[2], "expensive operation is executed in order"),
+		test.Equal(4, order[3], "cheap operation is executed after the expensive one"),
+		test.Equal(0, q.Length(), "queue length"),
+	)
+}
+
+func TestQueue_CancelledWhileWaiting(t *testing.T) {
+	q := img.NewQueue()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		_ = q.AddAndWait(blockingOp(started, release), func() {})
+		close(done)
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	executed := false
+	op := &img.Command{
+		Transformation: func(input *img.TransformationConfig) (*img.Image, error) {
+			executed = true
+			return &img.Image{}, nil
+		},
+		Config: &img.TransformationConfig{
+			Src:     &img.Image{Id: "img.png"},
+			Context: ctx,
+		},
+	}
+	go func() {
+		for q.Length() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	callbackCalled := false
+	err := q.AddAndWait(op, func() {
+		callbackCalled = true
+	})
+
+	close(release)
+	<-done
+
+	test.Error(t,
+		test.Equal(true, errors.Is(err, context.Canceled), "error"),
+		test.Equal(false, executed, "operation is executed"),
+		test.Equal(false, callbackCalled, "callback is called"),
+		test.Equal(0, q.Length(), "queue length"),
+	)
+}
@@ -0,0 +1,190 @@
+package img
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the limit of requests per client.
+type RateLimit struct {
+	// Rate is the number of requests per second. 0 means no limit.
+	Rate float64
+	// Burst is the number of requests that could be made at once. If 0, then
+	// Rate rounded up is used.
+	Burst int
+}
+
+// ClientFunc returns the key of the client that rate limits are applied to,
+// e.g. the IP address of the client.
+type ClientFunc func(req *http.Request, imgUrl string) string
+
+// RateLimiter limits the number of requests per client using token buckets. Requests
+// that are served from the cache are cheap comparing to transformations, so they
+// have a separate limit. Nil RateLimiter doesn't limit requests.
+//
+// Up to maxBuckets clients are tracked and the least recently seen clients are
+// forgotten when the limit is reached, so random client keys can't exhaust the memory.
+type RateLimiter struct {
+	// Client returns the key of the client. If nil, then ClientIP without trusted proxies is used.
+	Client ClientFunc
+	// Hits is the limit of requests served from the cache and requests of original images.
+	Hits RateLimit
+	// Misses is the limit of requests that are transformed.
+	Misses RateLimit
+
+	mux     sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// maxBuckets is the maximum number of buckets that are tracked.
+const maxBuckets = 10000
+
+// allowHit takes a token from the bucket of the client for the request served from the cache.
+// Returns 429 HttpError with Retry-After header if the client exceeded the limit.
+func (l *RateLimiter) allowHit(req *http.Request, imgUrl string) error {
+	if l == nil {
+		return nil
+	}
+	return l.allow("hit", l.Hits, req, imgUrl)
+}
+
+// allowMiss takes a token from the bucket of the client for the transformation.
+// Returns 429 HttpError with Retry-After header if the client exceeded the limit.
+func (l *RateLimiter) allowMiss(req *http.Request, imgUrl string) error {
+	if l == nil {
+		return nil
+	}
+	return l.allow("miss", l.Misses, req, imgUrl)
+}
+
+func (l *RateLimiter) allow(kind string, limit RateLimit, req *http.Request, imgUrl string) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	client := l.Client
+	if client == nil {
+		client = ClientIP(nil)
+	}
+	clientKey := client(req, imgUrl)
+
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Ceil(limit.Rate)
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*list.Element)
+		l.lru = list.New()
+	}
+
+	key := kind + "|" + clientKey
+	var b *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		b = elem.Value.(*tokenBucket)
+	} else {
+		if l.lru.Len() >= maxBuckets {
+			oldest := l.lru.Remove(l.lru.Back()).(*tokenBucket)
+			delete(l.buckets, oldest.key)
+		}
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		retryAfter := math.Ceil((1 - b.tokens) / limit.Rate)
+		err := NewHttpError(http.StatusTooManyRequests, fmt.Sprintf("rate limit of %g requests per second is exceeded", limit.Rate))
+		err.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, retryAfter))))
+		return err
+	}
+	b.tokens--
+
+	return nil
+}
+
+// ClientIP returns ClientFunc that uses the IP address of the client. If the request came
+// from the trusted proxy, then the last address in X-Forwarded-For header that is not
+// a trusted proxy is used.
+func ClientIP(trustedProxies []*net.IPNet) ClientFunc {
+	trusted := func(ip net.IP) bool {
+		for _, n := range trustedProxies {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(req *http.Request, _ string) string {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !trusted(ip) {
+			return host
+		}
+
+		forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(forwarded[i])
+			forwardedIp := net.ParseIP(addr)
+			if forwardedIp == nil {
+				break
+			}
+			host = addr
+			if !trusted(forwardedIp) {
+				break
+			}
+		}
+
+		return host
+	}
+}
+
+// ClientApiKey returns ClientFunc that uses the API key of the request. Requests without
+// API key are limited using fallback.
+func ClientApiKey(fallback ClientFunc) ClientFunc {
+	return func(req *http.Request, imgUrl string) string {
+		key, _ := getQueryParam(req.URL, AuthParam)
+		if len(key) == 0 {
+			key = req.Header.Get(AuthHeader)
+		}
+		if len(key) == 0 {
+			return fallback(req, imgUrl)
+		}
+		return "key:" + key
+	}
+}
+
+// ClientOriginHost is ClientFunc that uses the host of the source image, so
+// all clients requesting images from the same origin share the limit.
+func ClientOriginHost(_ *http.Request, imgUrl string) string {
+	u, err := url.Parse(imgUrl)
+	if err != nil {
+		return imgUrl
+	}
+	return strings.ToLower(u.Hostname())
+}
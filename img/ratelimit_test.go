@@ -0,0 +1,117 @@
+package img_test
+
+import (
+	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	client := img.ClientIP([]*net.IPNet{proxies})
+
+	request := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/img/site.com/img.png/optimise", nil)
+		req.RemoteAddr = remoteAddr
+		for _, f := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		return req
+	}
+
+	test.Error(t,
+		test.Equal("1.2.3.4", client(request("1.2.3.4:1234"), ""), "direct request"),
+		test.Equal("1.2.3.4", client(request("1.2.3.4:1234", "5.6.7.8"), ""), "untrusted proxy"),
+		test.Equal("5.6.7.8", client(request("10.0.0.1:1234", "5.6.7.8"), ""), "trusted proxy"),
+		test.Equal("5.6.7.8", client(request("10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 10.0.0.2"), ""), "chain of trusted proxies"),
+		test.Equal("5.6.7.8", client(request("10.0.0.1:1234", "9.9.9.9", "5.6.7.8"), ""), "multiple headers"),
+		test.Equal("10.0.0.1", client(request("10.0.0.1:1234"), ""), "trusted proxy without header"),
+	)
+}
+
+func TestClientApiKey(t *testing.T) {
+	client := img.ClientApiKey(img.ClientIP(nil))
+
+	withKey := httptest.NewRequest(http.MethodGet, "http://localhost/img/site.com/img.png/optimise?auth=123", nil)
+	withHeader := httptest.NewRequest(http.MethodGet, "http://localhost/img/site.com/img.png/optimise", nil)
+	withHeader.Header.Set(img.AuthHeader, "123")
+	withoutKey := httptest.NewRequest(http.MethodGet, "http://localhost/img/site.com/img.png/optimise", nil)
+	withoutKey.RemoteAddr = "1.2.3.4:1234"
+
+	test.Error(t,
+		test.Equal("key:123", client(withKey, ""), "key in the query"),
+		test.Equal("key:123", client(withHeader, ""), "key in the header"),
+		test.Equal("1.2.3.4", client(withoutKey, ""), "fallback"),
+		test.Equal("site.com", img.ClientOriginHost(withKey, "http://Site.com/img.png"), "origin host"),
+	)
+}
+
+func TestService_RateLimit(t *testing.T) {
+	s := createService(t)
+	s.Cache = img.NewMemoryCache(1024)
+	s.RateLimiter = &img.RateLimiter{
+		Hits:   img.RateLimit{Rate: 0.01, Burst: 2},
+		Misses: img.RateLimit{Rate: 0.01, Burst: 1},
+	}
+
+	request := func(remoteAddr string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/"+path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		s.GetRouter().ServeHTTP(w, req)
+		return w
+	}
+
+	miss := request("1.1.1.1:1234", "img.png/optimise")
+	secondMiss := request("1.1.1.1:1234", "img2.png/optimise")
+	otherClientMiss := request("2.2.2.2:1234", "img2.png/optimise")
+	hit := request("1.1.1.1:1234", "img.png/optimise")
+	asIs := request("1.1.1.1:1234", "img.png/asis")
+	limitedHit := request("1.1.1.1:1234", "img.png/optimise")
+
+	test.Error(t,
+		test.Equal(http.StatusOK, miss.Code, "first miss"),
+		test.Equal(http.StatusTooManyRequests, secondMiss.Code, "second miss"),
+		test.Equal("100", secondMiss.Header().Get("Retry-After"), "Retry-After header"),
+		test.Equal("no-store", secondMiss.Header().Get("Cache-Control"), "Cache-Control header"),
+		test.Equal(http.StatusOK, otherClientMiss.Code, "miss of another client"),
+		test.Equal(http.StatusOK, hit.Code, "hit"),
+		test.Equal(http.StatusOK, asIs.Code, "asis"),
+		test.Equal(http.StatusTooManyRequests, limitedHit.Code, "third hit"),
+	)
+}
+
+func TestService_RateLimitMaxClients(t *testing.T) {
+	s := createService(t)
+	s.RateLimiter = &img.RateLimiter{
+		Client: func(req *http.Request, _ string) string {
+			return req.Header.Get("X-Client")
+		},
+		Hits: img.RateLimit{Rate: 0.01, Burst: 1},
+	}
+
+	request := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis", nil)
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		s.GetRouter().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	first := request("first")
+	limited := request("first")
+	for i := 0; i < 10000; i++ {
+		request(fmt.Sprintf("client-%d", i))
+	}
+	forgotten := request("first")
+
+	test.Error(t,
+		test.Equal(http.StatusOK, first, "first request"),
+		test.Equal(http.StatusTooManyRequests, limited, "second request"),
+		test.Equal(http.StatusOK, forgotten, "request after the client is forgotten"),
+	)
+}
@@ -2,21 +2,35 @@ package img
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
 	"github.com/dooman87/glogi"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CacheTTL is the number of seconds  that will be written to max-age HTTP header
 var CacheTTL int
 
+// ErrorCacheTTL is the number of seconds that will be written to max-age HTTP header of client error responses,
+// e.g. when the source image is not found. If 0 then error responses won't be cached.
+// Server errors, e.g. 503 when the service is overloaded, and 401 errors are never cached.
+var ErrorCacheTTL int
+
 // SaveDataEnabled is the flag to enable/disable Save-Data client hint.
 // Sometime CDN doesn't support Save-Data in Vary response header in which
 // case you would need to set this to false
@@ -48,6 +62,20 @@ const (
 type ResizeConfig struct {
 	// Size is a size of output images in the format WxH.
 	Size string
+	// Gravity is the part of the image that is kept when the image is cropped
+	// by FitToSize, e.g. GravityNorth. If empty then the center is kept.
+	Gravity string
+	// Focus is the point of the source image that is kept in the center of the result
+	// image where possible when Gravity is GravityFocus.
+	Focus Point
+	// Crop is the name of the strategy that chooses the part of the image that is kept
+	// when the image is cropped by FitToSize, e.g. CropSmart. Overrides Gravity.
+	Crop string
+	// Mode is the mode of FitToSize, e.g. ModePad. If empty then ModeCrop is used.
+	Mode string
+	// Background is the color of the padding in ModePad in the format #rrggbb or BackgroundTransparent.
+	// If empty then the padding is transparent when the output format supports it and white otherwise.
+	Background string
 }
 
 // TransformationConfig is a configuration passed to Processor
@@ -66,6 +94,28 @@ type TransformationConfig struct {
 	TrimBorder bool
 	// Config is the configuration for the specific transformation
 	Config interface{}
+	// Context is the context of the transformation, typically, the context of an incoming request.
+	// Processor should stop the transformation when the context is cancelled.
+	Context context.Context
+	// SrcInfo is the information about the source image if it was loaded before
+	// the transformation, e.g. to estimate the cost. Processor could use it
+	// instead of loading the information again.
+	SrcInfo *Info
+	// Overlay is the image that should be composited on top of the result image. Optional.
+	Overlay *Overlay
+	// Orientation is applied to the source image before the transformation.
+	Orientation Orientation
+}
+
+// Orientation changes the orientation of images that can't be fixed automatically,
+// e.g. when EXIF is missing. Rotation is applied before flipping.
+type Orientation struct {
+	// Rotate is the clockwise rotation in degrees: 0, 90, 180 or 270.
+	Rotate int
+	// Flip mirrors the image vertically.
+	Flip bool
+	// Flop mirrors the image horizontally.
+	Flop bool
 }
 
 // Processor is the interface for transforming/optimising images.
@@ -73,7 +123,8 @@ type TransformationConfig struct {
 // Each function accepts original image and a list of supported
 // output format by client. Each format should be a MIME type, e.g.
 // image/png, image/webp. The output image will be encoded in one
-// of those formats.
+// of those formats. If TransformationConfig.Overlay is set then
+// it should be composited on top of the output image.
 type Processor interface {
 	// Resize resizes given image preserving aspect ratio.
 	// Format of the size argument is width'x'height.
@@ -90,14 +141,58 @@ type Processor interface {
 
 	// Optimise optimises given image to reduce size of the served image.
 	Optimise(input *TransformationConfig) (*Image, error)
+
+	// Crop crops the rectangle set by CropConfig from given image and resizes
+	// it preserving aspect ratio if the size is set.
+	Crop(input *TransformationConfig) (*Image, error)
+}
+
+// CostPerProcessor is the budget of the queue per each processor. It's also the estimated
+// cost of decoding and encoding 1 megapixel JPEG or PNG image, so there are as many typical
+// transformations executed at the same time as processors. Smaller images cost less and
+// bigger images or more expensive formats cost more. Transformations are estimated
+// at CostPerProcessor if Processor doesn't implement CostEstimator.
+const CostPerProcessor = 4
+
+// CostEstimator could be implemented by Processor to estimate the cost of
+// the transformation before adding it to the queue. Expensive transformations,
+// e.g. encoding big images to AVIF, take a bigger part of the queue budget, so
+// fewer of them are executed at the same time.
+//
+// The estimation itself is executed in the queue with the cost of 1, because it
+// usually needs to read the source image.
+type CostEstimator interface {
+	// EstimateCost returns the cost of the transformation in units where CostPerProcessor
+	// is roughly the cost of decoding and encoding 1 megapixel JPEG or PNG image.
+	EstimateCost(input *TransformationConfig) (int, error)
 }
 
 type Service struct {
-	Loader      Loader
-	Processor   Processor
-	Q           []*Queue
-	currProc    int
-	currProcMux sync.Mutex
+	Loader    Loader
+	Processor Processor
+	// Q is the queue of transformations shared by all requests.
+	Q *Queue
+	// Cache stores transformed images. Optional, if nil then results won't be cached.
+	Cache Cache
+	// Signer verifies signatures of requested URLs. Optional, if nil then
+	// signatures are not required.
+	Signer *Signer
+	// Keys are API keys that are required to transform images. Optional, if nil then
+	// API keys are not required.
+	Keys KeyStore
+	// RateLimiter limits requests per client. Optional, if nil then requests are not limited.
+	RateLimiter *RateLimiter
+	// Presets are named transformations that could be requested using /img/{imgUrl}/{preset}.
+	Presets map[string]*Preset
+	// DisabledFormats are output formats that won't be used even if they are supported by
+	// the client, e.g. image/avif.
+	DisabledFormats []string
+	// Watermarks are overlays that could be requested by name using the watermark query param.
+	Watermarks  map[string]*Watermark
+	overlays    overlays
+	flights     flightGroup
+	cacheHits   uint64
+	cacheMisses uint64
 }
 
 type Cmd func(input *TransformationConfig) (*Image, error)
@@ -107,9 +202,13 @@ type Command struct {
 	Config         *TransformationConfig
 	Resp           http.ResponseWriter
 	Result         *Image
-	FinishedCond   *sync.Cond
-	Finished       bool
 	Err            error
+	// Cost is the estimated cost of the transformation.
+	// See CostEstimator for details.
+	Cost int
+	// Stats are collected during the transformation and added to the response headers.
+	// Nil if Server-Timing and debug headers are disabled.
+	Stats *Stats
 }
 
 var emptyGif = [...]byte{0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x1, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x21, 0xf9, 0x4, 0x1, 0xa, 0x0, 0x1, 0x0, 0x2c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x2, 0x2, 0x4c, 0x1, 0x0, 0x3b}
@@ -124,46 +223,48 @@ func NewService(r Loader, p Processor, procNum int) (*Service, error) {
 	srv := &Service{
 		Loader:    r,
 		Processor: p,
-		Q:         make([]*Queue, procNum),
+		Q:         NewQueue(),
 	}
-
-	for i := 0; i < procNum; i++ {
-		srv.Q[i] = NewQueue()
-	}
-	srv.currProc = 0
+	srv.Q.Name = "transformations"
+	srv.Q.Budget = procNum * CostPerProcessor
 
 	return srv, nil
 }
 
 func (r *Service) GetRouter() *mux.Router {
 	router := mux.NewRouter().SkipClean(true)
-	router.HandleFunc("/img/{imgUrl:.*}/resize", r.ResizeUrl)
-	router.HandleFunc("/img/{imgUrl:.*}/fit", r.FitToSizeUrl)
-	router.HandleFunc("/img/{imgUrl:.*}/asis", r.AsIs)
-	router.HandleFunc("/img/{imgUrl:.*}/optimise", r.OptimiseUrl)
+	router.HandleFunc("/img/{imgUrl:.*}/resize", instrument("resize", r.ResizeUrl))
+	router.HandleFunc("/img/{imgUrl:.*}/fit", instrument("fit", r.FitToSizeUrl))
+	router.HandleFunc("/img/{imgUrl:.*}/asis", instrument("asis", r.AsIs))
+	router.HandleFunc("/img/{imgUrl:.*}/optimise", instrument("optimise", r.OptimiseUrl))
+	router.HandleFunc("/img/{imgUrl:.*}/crop", instrument("crop", r.CropUrl))
+	router.HandleFunc("/img/{imgUrl:.*}/{preset:[a-zA-Z0-9_-]+}", instrument("preset", r.PresetUrl))
 
 	return router
 }
 
 func (r *Service) OptimiseUrl(resp http.ResponseWriter, req *http.Request) {
-	r.transformUrl(resp, req, r.Processor.Optimise, nil)
+	r.transformUrl(resp, req, "optimise", r.Processor.Optimise, nil)
 }
 
+// resizeSizeRegexp matches the size of resized images, e.g. 300x200, 300 or x200.
+var resizeSizeRegexp = regexp.MustCompile(`^\d*[x]?\d*$`)
+
+// fitSizeRegexp matches the size of fit images that must be in format WxH.
+var fitSizeRegexp = regexp.MustCompile(`^\d*[x]\d*$`)
+
 func (r *Service) ResizeUrl(resp http.ResponseWriter, req *http.Request) {
 	size, _ := getQueryParam(req.URL, "size")
 	if len(size) == 0 {
 		http.Error(resp, "size param is required", http.StatusBadRequest)
 		return
 	}
-	if match, err := regexp.MatchString(`^\d*[x]?\d*$`, size); !match || err != nil {
-		if err != nil {
-			Log.Printf("Error while matching size: %s\n", err.Error())
-		}
+	if !resizeSizeRegexp.MatchString(size) {
 		http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
 		return
 	}
 
-	r.transformUrl(resp, req, r.Processor.Resize, &ResizeConfig{Size: size})
+	r.transformUrl(resp, req, "resize", r.Processor.Resize, &ResizeConfig{Size: size})
 }
 
 func (r *Service) FitToSizeUrl(resp http.ResponseWriter, req *http.Request) {
@@ -172,23 +273,91 @@ func (r *Service) FitToSizeUrl(resp http.ResponseWriter, req *http.Request) {
 		http.Error(resp, "size param is required", http.StatusBadRequest)
 		return
 	}
-	if match, err := regexp.MatchString(`^\d*[x]\d*$`, size); !match || err != nil {
+	if !fitSizeRegexp.MatchString(size) {
+		http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
+		return
+	}
+
+	config := &ResizeConfig{Size: size}
+	if gravity, ok := getQueryParam(req.URL, "gravity"); ok {
+		config.Gravity = strings.ToLower(gravity)
+		if !gravities[config.Gravity] {
+			http.Error(resp, "gravity param should be one of center, north, northeast, east, southeast, south, southwest, west, northwest", http.StatusBadRequest)
+			return
+		}
+	}
+	if focus, ok := getQueryParam(req.URL, "focus"); ok {
+		var err error
+		config.Focus, err = parseFocus(focus)
 		if err != nil {
-			Log.Printf("Error while matching size: %s\n", err.Error())
+			http.Error(resp, fmt.Sprintf("focus param should be in format x,y: %s", err), http.StatusBadRequest)
+			return
 		}
-		http.Error(resp, "size param should be in format WxH", http.StatusBadRequest)
+		config.Gravity = GravityFocus
+	}
+	if crop, ok := getQueryParam(req.URL, "crop"); ok {
+		config.Crop = strings.ToLower(crop)
+		if !cropStrategies[config.Crop] {
+			http.Error(resp, "crop param should be smart", http.StatusBadRequest)
+			return
+		}
+	}
+	if mode, ok := getQueryParam(req.URL, "mode"); ok {
+		switch strings.ToLower(mode) {
+		case ModeCrop:
+		case ModePad:
+			config.Mode = ModePad
+		default:
+			http.Error(resp, "mode param should be one of crop, pad", http.StatusBadRequest)
+			return
+		}
+	}
+	if bg, ok := getQueryParam(req.URL, "bg"); ok {
+		if config.Mode != ModePad {
+			http.Error(resp, "bg param is only supported in pad mode", http.StatusBadRequest)
+			return
+		}
+		var err error
+		config.Background, err = parseBackground(bg)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("bg param should be in format RRGGBB: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if config.Mode == ModePad && (config.Gravity == GravityFocus || len(config.Crop) > 0) {
+		http.Error(resp, "focus and crop params are not supported in pad mode", http.StatusBadRequest)
+		return
+	}
+	// Focus and crop are calculated on the source image before the border is trimmed
+	if trimBorder, _ := getBoolQueryParam(req.URL, "trim-border"); trimBorder && (config.Gravity == GravityFocus || len(config.Crop) > 0) {
+		http.Error(resp, "focus and crop params are not supported with trim-border", http.StatusBadRequest)
 		return
 	}
 
-	r.transformUrl(resp, req, r.Processor.FitToSize, &ResizeConfig{Size: size})
+	r.transformUrl(resp, req, "fit", r.Processor.FitToSize, config)
 }
 
 func (r *Service) AsIs(resp http.ResponseWriter, req *http.Request) {
+	if err := r.verifySignature(req); err != nil {
+		sendError(resp, err)
+		return
+	}
+
 	imgUrl := getImgUrl(req)
 	if len(imgUrl) == 0 {
 		http.Error(resp, "url param is required", http.StatusBadRequest)
 		return
 	}
+	if r.Keys != nil {
+		if err := authenticate(r.Keys, resp, req, imgUrl); err != nil {
+			sendError(resp, err)
+			return
+		}
+	}
+	if err := r.RateLimiter.allowHit(req, imgUrl); err != nil {
+		sendError(resp, err)
+		return
+	}
 
 	Log.Printf("Requested image %s as is\n", imgUrl)
 
@@ -202,13 +371,18 @@ func (r *Service) AsIs(resp http.ResponseWriter, req *http.Request) {
 		proxyHeaders.Add("Accept-Encoding", acceptEncoding)
 	}
 
-	result, err := r.Loader.Load(imgUrl, NewContextWithHeaders(req.Context(), &proxyHeaders))
+	result, err := r.load(NewContextWithHeaders(req.Context(), &proxyHeaders), imgUrl)
 
 	if err != nil {
 		sendError(resp, err)
 		return
 	}
 
+	if isNotModified(req, result) {
+		writeNotModified(resp, result)
+		return
+	}
+
 	r.execOp(&Command{
 		Config: &TransformationConfig{
 			Src: &Image{
@@ -221,26 +395,77 @@ func (r *Service) AsIs(resp http.ResponseWriter, req *http.Request) {
 }
 
 func (r *Service) execOp(op *Command) {
-	op.FinishedCond = sync.NewCond(&sync.Mutex{})
-
-	queue := r.getQueue()
-	queue.AddAndWait(op, func() {
+	err := r.Q.AddAndWait(op, func() {
 		Log.Printf("Image [%s] transformed successfully, writing to the response", op.Config.Src.Id)
 		writeResult(op)
 	})
+	if err != nil {
+		sendError(op.Resp, err)
+	}
+}
+
+// estimateCost sets the cost of the operation using CostEstimator if Processor implements it.
+// The estimation is added to the queue, so it's limited by the budget, MaxLength
+// and MaxWait in the same way as transformations. Errors of the estimation are set to op.Err.
+func (r *Service) estimateCost(op *Command) error {
+	estimator, ok := r.Processor.(CostEstimator)
+	if !ok {
+		op.Cost = CostPerProcessor
+		return nil
+	}
+
+	estimation := &Command{
+		Transformation: func(config *TransformationConfig) (*Image, error) {
+			cost, err := estimator.EstimateCost(config)
+			op.Cost = cost
+			return nil, err
+		},
+		Config: op.Config,
+		Cost:   1,
+	}
+	err := r.Q.AddAndWait(estimation, func() {})
+	if err != nil {
+		return err
+	}
+	op.Err = estimation.Err
+
+	return nil
+}
+
+// verifySignature checks the signature of the requested URL if Signer is set.
+// Requests of presets are verified before the preset is applied.
+func (r *Service) verifySignature(req *http.Request) error {
+	if r.Signer == nil || isPreset(req) {
+		return nil
+	}
+	return r.Signer.Verify(req.URL)
 }
 
-func (r *Service) getQueue() *Queue {
-	// Get the next execution channel
-	r.currProcMux.Lock()
-	r.currProc++
-	if r.currProc == len(r.Q) {
-		r.currProc = 0
+// load loads the source image using Loader and records the span and the timing of loading.
+func (r *Service) load(ctx context.Context, imgUrl string) (*Image, error) {
+	ctx, span := tracer().Start(ctx, "load", trace.WithAttributes(attribute.String("image.url", imgUrl)))
+	defer span.End()
+
+	start := time.Now()
+	image, err := r.Loader.Load(imgUrl, ctx)
+	StatsFromContext(ctx).AddTiming("load", time.Since(start))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
-	procIdx := r.currProc
-	r.currProcMux.Unlock()
+	span.SetAttributes(
+		attribute.Int("image.size", len(image.Data)),
+		attribute.String("image.mime_type", image.MimeType),
+	)
 
-	return r.Q[procIdx]
+	return image, nil
+}
+
+// CacheStats returns the number of requests that were served from the cache
+// and the number of requests that missed the cache.
+func (r *Service) CacheStats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&r.cacheHits), atomic.LoadUint64(&r.cacheMisses)
 }
 
 // Adds Content-Length and Cache-Control headers
@@ -254,6 +479,102 @@ func addHeaders(resp http.ResponseWriter, image *Image) {
 	}
 	headers.Add("Content-Length", strconv.Itoa(len(image.Data)))
 	headers.Add("Cache-Control", fmt.Sprintf("public, max-age=%d", CacheTTL))
+	addValidatorHeaders(resp, image)
+}
+
+// Adds ETag and Last-Modified headers
+func addValidatorHeaders(resp http.ResponseWriter, image *Image) {
+	headers := resp.Header()
+	if len(image.ETag) != 0 {
+		headers.Set("ETag", image.ETag)
+	}
+	if len(image.LastModified) != 0 {
+		headers.Set("Last-Modified", image.LastModified)
+	}
+}
+
+// isNotModified checks whether the client already has the image using
+// If-None-Match and If-Modified-Since headers of the request.
+func isNotModified(req *http.Request, image *Image) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		return etagMatches(ifNoneMatch, image.ETag)
+	}
+
+	ifModifiedSince := req.Header.Get("If-Modified-Since")
+	if len(ifModifiedSince) == 0 || len(image.LastModified) == 0 {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(image.LastModified)
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(since)
+}
+
+// etagMatches checks whether the value of If-None-Match header matches
+// the ETag using weak comparison.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeNotModified(resp http.ResponseWriter, image *Image) {
+	resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", CacheTTL))
+	addValidatorHeaders(resp, image)
+	resp.WriteHeader(http.StatusNotModified)
+}
+
+// transformedETag generates a strong ETag of the transformed image. It's derived from
+// the validator of the source image and the cache key which includes all parameters of
+// the transformation. The output format is defined by the source image and
+// the supported formats which are part of the key as well.
+func transformedETag(src *Image, key string) string {
+	hash := sha256.New()
+	switch {
+	case len(src.ETag) > 0:
+		hash.Write([]byte(src.ETag))
+	case len(src.LastModified) > 0:
+		hash.Write([]byte(src.LastModified))
+	default:
+		hash.Write(src.Data)
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil)[:16])
+}
+
+// Adds Cache-Control header to error responses
+func addErrorHeaders(resp http.ResponseWriter, code int) {
+	if ErrorCacheTTL > 0 && code >= 400 && code < 500 && code != http.StatusTooManyRequests && code != http.StatusUnauthorized {
+		resp.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", ErrorCacheTTL))
+	} else {
+		resp.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// Adds headers of the error to the response
+func copyHeaders(resp http.ResponseWriter, err *HttpError) {
+	for name, values := range err.Header() {
+		for _, value := range values {
+			resp.Header().Add(name, value)
+		}
+	}
 }
 
 func getQueryParam(url *url.URL, name string) (string, bool) {
@@ -263,6 +584,19 @@ func getQueryParam(url *url.URL, name string) (string, bool) {
 	return "", url.Query().Has(name)
 }
 
+// getBoolQueryParam returns true if the param is passed without value
+// or with the value that could be parsed as true, e.g. ?flip or ?flip=1.
+func getBoolQueryParam(url *url.URL, name string) (bool, error) {
+	value, ok := getQueryParam(url, name)
+	if !ok {
+		return false, nil
+	}
+	if len(value) == 0 {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
 func getImgUrl(req *http.Request) string {
 	imgUrl := mux.Vars(req)["imgUrl"]
 	if len(imgUrl) == 0 {
@@ -291,8 +625,18 @@ func getSupportedFormats(req *http.Request) []string {
 }
 
 func writeResult(op *Command) {
+	addStatsHeaders(op.Resp, op.Stats)
+
 	if op.Err != nil {
-		http.Error(op.Resp, fmt.Sprintf("Error transforming image: '%s'", op.Err.Error()), http.StatusInternalServerError)
+		var httpErr *HttpError
+		if errors.As(op.Err, &httpErr) {
+			addErrorHeaders(op.Resp, httpErr.Code())
+			copyHeaders(op.Resp, httpErr)
+			http.Error(op.Resp, httpErr.Error(), httpErr.Code())
+		} else {
+			addErrorHeaders(op.Resp, http.StatusInternalServerError)
+			http.Error(op.Resp, fmt.Sprintf("Error transforming image: '%s'", op.Err.Error()), http.StatusInternalServerError)
+		}
 		return
 	}
 
@@ -300,12 +644,23 @@ func writeResult(op *Command) {
 	_, _ = op.Resp.Write(op.Result.Data)
 }
 
-func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, transformation Cmd, config interface{}) {
+func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, opName string, transformation Cmd, config interface{}) {
+	if err := r.verifySignature(req); err != nil {
+		sendError(resp, err)
+		return
+	}
+
 	imgUrl := getImgUrl(req)
 	if len(imgUrl) == 0 {
 		http.Error(resp, "url param is required", http.StatusBadRequest)
 		return
 	}
+	if r.Keys != nil {
+		if err := authenticate(r.Keys, resp, req, imgUrl); err != nil {
+			sendError(resp, err)
+			return
+		}
+	}
 
 	var dppx float64 = 0
 	dppxParam, _ := getQueryParam(req.URL, "dppx")
@@ -327,17 +682,37 @@ func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, tran
 		}
 	}
 
-	var trimBorder = false
-	trimBorderParamValue, trimBorderParamExist := getQueryParam(req.URL, "trim-border")
-	if trimBorderParamExist {
-		if len(trimBorderParamValue) == 0 {
-			trimBorder = true
-		} else {
-			var err error
-			trimBorder, err = strconv.ParseBool(trimBorderParamValue)
-			if err != nil {
-				http.Error(resp, "can't parse trim-border param", http.StatusBadRequest)
-			}
+	trimBorder, err := getBoolQueryParam(req.URL, "trim-border")
+	if err != nil {
+		http.Error(resp, "can't parse trim-border param", http.StatusBadRequest)
+		return
+	}
+
+	var orientation Orientation
+	if rotate, ok := getQueryParam(req.URL, "rotate"); ok {
+		switch rotate {
+		case "90", "180", "270":
+			orientation.Rotate, _ = strconv.Atoi(rotate)
+		default:
+			http.Error(resp, "rotate param should be one of 90, 180, 270", http.StatusBadRequest)
+			return
+		}
+	}
+	if orientation.Flip, err = getBoolQueryParam(req.URL, "flip"); err != nil {
+		http.Error(resp, "can't parse flip param", http.StatusBadRequest)
+		return
+	}
+	if orientation.Flop, err = getBoolQueryParam(req.URL, "flop"); err != nil {
+		http.Error(resp, "can't parse flop param", http.StatusBadRequest)
+		return
+	}
+
+	var watermark *Watermark
+	if name, ok := getQueryParam(req.URL, WatermarkParam); ok {
+		watermark, ok = r.Watermarks[name]
+		if !ok {
+			http.Error(resp, fmt.Sprintf("watermark [%s] is not found", name), http.StatusBadRequest)
+			return
 		}
 	}
 
@@ -356,29 +731,177 @@ func (r *Service) transformUrl(resp http.ResponseWriter, req *http.Request, tran
 		resp.Header().Add("Vary", "Accept")
 	}
 
-	supportedFormats := getSupportedFormats(req)
+	supportedFormats := r.enabledFormats(getSupportedFormats(req))
+	quality := getQuality(saveDataHeader, saveDataParam, dppx)
+
+	key := cacheKey(imgUrl, opName, config, supportedFormats, quality, trimBorder, watermark, orientation)
+	if r.Cache != nil {
+		start := time.Now()
+		cached, ok := r.Cache.Get(key)
+		if ok {
+			atomic.AddUint64(&r.cacheHits, 1)
+			metrics.ObserveCache(true)
+			Log.Printf("Image [%s] found in the cache\n", imgUrl)
+			if err := r.RateLimiter.allowHit(req, imgUrl); err != nil {
+				sendError(resp, err)
+				return
+			}
+			if isNotModified(req, cached) {
+				writeNotModified(resp, cached)
+				return
+			}
+			stats := newStats()
+			stats.AddTiming("cache", time.Since(start))
+			writeResult(&Command{Result: cached, Resp: resp, Stats: stats})
+			return
+		}
+		atomic.AddUint64(&r.cacheMisses, 1)
+		metrics.ObserveCache(false)
+	}
+	if err := r.RateLimiter.allowMiss(req, imgUrl); err != nil {
+		sendError(resp, err)
+		return
+	}
+
+	// Identical requests that are processed at the same time share the result
+	var etag string
+	op, err, shared := r.flights.do(req.Context(), key, func(ctx context.Context, loaded func(etag string)) (*Command, error) {
+		stats := newStats()
+		ctx = NewContextWithStats(ctx, stats)
+
+		srcImage, err := r.load(ctx, imgUrl)
+		if err != nil {
+			return nil, err
+		}
+		resultETag := transformedETag(srcImage, key)
+		loaded(resultETag)
+
+		overlay, err := r.overlay(ctx, watermark)
+		if err != nil {
+			return nil, err
+		}
+
+		Log.Printf("Source image [%s] loaded successfully, adding to the queue\n", imgUrl)
+
+		op := &Command{
+			Transformation: transformation,
+			Config: &TransformationConfig{
+				Src:              srcImage,
+				SupportedFormats: supportedFormats,
+				Quality:          quality,
+				TrimBorder:       trimBorder,
+				Config:           config,
+				Context:          ctx,
+				Overlay:          overlay,
+				Orientation:      orientation,
+			},
+			Stats: stats,
+		}
+		err = r.estimateCost(op)
+		if err != nil {
+			return nil, err
+		}
+		if op.Err != nil {
+			return op, nil
+		}
+		err = r.Q.AddAndWait(op, func() {
+			Log.Printf("Image [%s] transformed successfully", imgUrl)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Err == nil && op.Result != nil {
+			metrics.ObserveTransformation(opName, len(srcImage.Data), len(op.Result.Data))
+			stats.SetDebug(DebugSourceBytes, strconv.Itoa(len(srcImage.Data)))
+			stats.SetDebug(DebugOutputBytes, strconv.Itoa(len(op.Result.Data)))
+			op.Result.ETag = resultETag
+			if r.Cache != nil {
+				r.Cache.Set(key, op.Result)
+			}
+		}
 
-	srcImage, err := r.Loader.Load(imgUrl, req.Context())
+		return op, nil
+	}, func(loadedETag string) bool {
+		// Client has the image already, so we don't need to wait for the transformation
+		if isNotModified(req, &Image{ETag: loadedETag}) {
+			etag = loadedETag
+			return true
+		}
+		return false
+	})
+	if err == errNotModified {
+		writeNotModified(resp, &Image{ETag: etag})
+		return
+	}
 	if err != nil {
 		sendError(resp, err)
 		return
 	}
+	if shared {
+		Log.Printf("Image [%s] was transformed by the concurrent request, writing to the response", imgUrl)
+	}
+	if op.Err == nil && op.Result != nil && isNotModified(req, op.Result) {
+		writeNotModified(resp, op.Result)
+		return
+	}
 
-	Log.Printf("Source image [%s] loaded successfully, adding to the queue\n", imgUrl)
-
-	r.execOp(&Command{
-		Transformation: transformation,
-		Config: &TransformationConfig{
-			Src:              srcImage,
-			SupportedFormats: supportedFormats,
-			Quality:          getQuality(saveDataHeader, saveDataParam, dppx),
-			TrimBorder:       trimBorder,
-			Config:           config,
-		},
-		Resp: resp,
+	writeResult(&Command{
+		Result: op.Result,
+		Err:    op.Err,
+		Resp:   resp,
+		Stats:  op.Stats,
 	})
 }
 
+// enabledFormats removes DisabledFormats from the formats supported by the client.
+func (r *Service) enabledFormats(supportedFormats []string) []string {
+	if len(r.DisabledFormats) == 0 {
+		return supportedFormats
+	}
+
+	enabled := make([]string, 0, len(supportedFormats))
+	for _, f := range supportedFormats {
+		mimeType, _, _ := strings.Cut(f, ";")
+		disabled := false
+		for _, d := range r.DisabledFormats {
+			if strings.EqualFold(strings.TrimSpace(mimeType), d) {
+				disabled = true
+				break
+			}
+		}
+		if !disabled {
+			enabled = append(enabled, f)
+		}
+	}
+	return enabled
+}
+
+// cacheKey returns the key of the transformed image in the cache. Only image formats
+// from the Accept header are taken into account, because the output format
+// is negotiated using them. The watermark is included with its configuration, so
+// images are transformed again when the watermark is changed.
+func cacheKey(imgUrl string, opName string, config interface{}, supportedFormats []string, quality Quality, trimBorder bool, watermark *Watermark, orientation Orientation) string {
+	var formats []string
+	for _, f := range supportedFormats {
+		mimeType, _, _ := strings.Cut(f, ";")
+		mimeType = strings.TrimSpace(mimeType)
+		if strings.HasPrefix(mimeType, "image/") && mimeType != "image/*" {
+			formats = append(formats, mimeType)
+		}
+	}
+	sort.Strings(formats)
+
+	key := fmt.Sprintf("%s|%s|%+v|%s|%d|%t", imgUrl, opName, config, strings.Join(formats, ","), quality, trimBorder)
+	if watermark != nil {
+		key += fmt.Sprintf("|%+v", *watermark)
+	}
+	if orientation != (Orientation{}) {
+		key += fmt.Sprintf("|%+v", orientation)
+	}
+	return key
+}
+
 func getQuality(saveDataHeader string, saveDataParam string, dppx float64) Quality {
 	if dppx >= 2.0 {
 		return LOWER
@@ -395,13 +918,68 @@ func sendError(resp http.ResponseWriter, err error) {
 	if err != nil {
 		var httpErr *HttpError
 		if errors.As(err, &httpErr) {
+			addErrorHeaders(resp, httpErr.Code())
+			copyHeaders(resp, httpErr)
 			http.Error(resp, httpErr.Error(), httpErr.Code())
 		} else {
+			addErrorHeaders(resp, http.StatusInternalServerError)
 			http.Error(resp, fmt.Sprintf("Error reading image: '%s'", err.Error()), http.StatusInternalServerError)
 		}
 	}
 }
 
+// statusRecorder records the status code of the response for metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// instrument records metrics and the span of requests to the handler. Trace context
+// is extracted from the headers of the request, so the span continues the trace of the client.
+func instrument(operation string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: resp}
+
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer().Start(ctx, operation,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.url", req.URL.String())),
+		)
+		defer span.End()
+
+		handler(recorder, req.WithContext(ctx))
+
+		code := recorder.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", code))
+		if code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(code))
+		}
+		metrics.ObserveRequest(operation, code, time.Since(start))
+	}
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/Pixboost/transformimgs/v8/img")
+}
+
 type headersKey int
 
 func NewContextWithHeaders(ctx context.Context, headers *http.Header) context.Context {
@@ -6,11 +6,20 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/Pixboost/transformimgs/v8/img/metrics"
 	"github.com/dooman87/kolibri/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const (
@@ -25,6 +34,7 @@ const (
 	ImgLowerQualityOut = "1"
 	ImgBorderTrimmed   = "777"
 	ImgGzipSvg         = "888"
+	ImgTooBig          = "999"
 
 	EmptyGifBase64Out = "R0lGODlhAQABAAAAACH5BAEKAAEALAAAAAABAAEAAAICTAEAOw=="
 )
@@ -55,9 +65,24 @@ func (r *resizerMock) FitToSize(config *img.TransformationConfig) (*img.Image, e
 	return r.resultImage(config), nil
 }
 
+func (r *resizerMock) Crop(config *img.TransformationConfig) (*img.Image, error) {
+	data := config.Src.Data
+	crop := config.Config.(*img.CropConfig)
+	if (string(data) != ImgSrc && string(data) != NoContentTypeImgSrc) ||
+		*crop != (img.CropConfig{X: 10, Y: 20, Width: 300, Height: 200}) {
+		return nil, errors.New("crop_error")
+	}
+
+	return r.resultImage(config), nil
+}
+
 func (r *resizerMock) Optimise(config *img.TransformationConfig) (*img.Image, error) {
 	data := config.Src.Data
 
+	if string(data) == ImgTooBig {
+		return nil, img.NewHttpError(http.StatusUnprocessableEntity, "image is too big")
+	}
+
 	if string(data) != ImgSrc && string(data) != NoContentTypeImgSrc {
 		return nil, errors.New("optimise_error")
 	}
@@ -125,7 +150,7 @@ type loaderMock struct{}
 
 func (l *loaderMock) Load(url string, ctx context.Context) (*img.Image, error) {
 	switch url {
-	case "http://site.com/img.png":
+	case "http://site.com/img.png", "products/img.png":
 		return &img.Image{
 			Data:     []byte(ImgSrc),
 			MimeType: "image/png",
@@ -137,6 +162,20 @@ func (l *loaderMock) Load(url string, ctx context.Context) (*img.Image, error) {
 			MimeType: "image/png",
 			Id:       url,
 		}, nil
+	case "http://site.com/too_big.png":
+		return &img.Image{
+			Data:     []byte(ImgTooBig),
+			MimeType: "image/png",
+			Id:       url,
+		}, nil
+	case "http://site.com/etag.png":
+		return &img.Image{
+			Data:         []byte(ImgSrc),
+			MimeType:     "image/png",
+			Id:           url,
+			ETag:         `"src-etag"`,
+			LastModified: "Mon, 02 Jan 2023 15:04:05 GMT",
+		}, nil
 	case "http://site.com/custom_error.png":
 		return nil, img.NewHttpError(http.StatusTeapot, "Uh oh :(")
 
@@ -161,6 +200,8 @@ func (l *loaderMock) Load(url string, ctx context.Context) (*img.Image, error) {
 type transformTest struct {
 	name      string
 	urlSuffix string
+	// trimBorderUnsupported is set if the transformation rejects trim-border param
+	trimBorderUnsupported bool
 }
 
 func TestNewService(t *testing.T) {
@@ -185,6 +226,11 @@ func TestService_Transforms(t *testing.T) {
 			name:      "Optimise",
 			urlSuffix: "/optimise?",
 		},
+		{
+			name:                  "Crop",
+			urlSuffix:             "/crop?rect=10,20,300,200&",
+			trimBorderUnsupported: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -361,19 +407,6 @@ func TestService_Transforms(t *testing.T) {
 						)
 					},
 				},
-				{
-					Description: "Trim Border",
-					Request: &http.Request{
-						Method: "GET",
-						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s&trim-border", tt.urlSuffix), t),
-					},
-					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
-						test.Error(t,
-							test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
-							test.Equal(ImgBorderTrimmed, w.Body.String(), "Resulted image"),
-						)
-					},
-				},
 				{
 					Description: "Trim Border False",
 					Request: &http.Request{
@@ -396,8 +429,28 @@ func TestService_Transforms(t *testing.T) {
 					Url:          fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/custom_error.png%s", tt.urlSuffix),
 					ExpectedCode: http.StatusTeapot,
 					Description:  "Uh oh :(",
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+						)
+					},
 				},
 			}
+			if !tt.trimBorderUnsupported {
+				testCases = append(testCases, test.TestCase{
+					Description: "Trim Border",
+					Request: &http.Request{
+						Method: "GET",
+						URL:    parseUrl(fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png%s&trim-border", tt.urlSuffix), t),
+					},
+					Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+						test.Error(t,
+							test.Equal("3", w.Header().Get("Content-Length"), "Content-Length header"),
+							test.Equal(ImgBorderTrimmed, w.Body.String(), "Resulted image"),
+						)
+					},
+				})
+			}
 
 			test.RunRequests(testCases)
 		})
@@ -553,6 +606,219 @@ func TestService_FitToSizeUrl(t *testing.T) {
 			ExpectedCode: http.StatusBadRequest,
 			Description:  "2 - Size param should be in format WxH",
 		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&gravity=NorthEast",
+			ExpectedCode: http.StatusOK,
+			Description:  "Gravity is case insensitive",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&gravity=top",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unknown gravity",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=30%25,60%25",
+			ExpectedCode: http.StatusOK,
+			Description:  "Focus in percents",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=100,200",
+			ExpectedCode: http.StatusOK,
+			Description:  "Focus in pixels",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=100",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Focus should have 2 coordinates",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=10%25,200",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Focus coordinates should be in the same units",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=150%25,20%25",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Focus should be inside the image",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&crop=smart",
+			ExpectedCode: http.StatusOK,
+			Description:  "Smart crop",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&crop=faces",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unknown crop strategy",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad",
+			ExpectedCode: http.StatusOK,
+			Description:  "Pad mode",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad&bg=%23FFF",
+			ExpectedCode: http.StatusOK,
+			Description:  "Pad mode with short hex background",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad&bg=transparent&gravity=north",
+			ExpectedCode: http.StatusOK,
+			Description:  "Pad mode with transparent background",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=stretch",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Unknown mode",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad&bg=red",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Background should be in hex",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad&bg=%23ffff",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Background should have 3 or 6 hex digits",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&bg=ffffff",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Background is only supported in pad mode",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&mode=pad&crop=smart",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Smart crop is not supported in pad mode",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&focus=10,20&trim-border",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Focus is not supported with trim-border",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200&crop=smart&trim-border",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Smart crop is not supported with trim-border",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_CropUrl(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img//crop?rect=10,20,300,200",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Source image URL is required",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Param rect is required",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=10,20,300",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rect should have 4 numbers",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=10,20,-300,200",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rect should have positive numbers",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=10,20,0,200",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rect should have positive size",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=99999999999999999999,0,10,10",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rect should have reasonable numbers",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=50%25,0%25,60%25,100%25",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rect should be inside the image",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=10,20,300,200&size=BADSIZE",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Size param should be in format WxH",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/crop?rect=10,20,300,200&trim-border",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Trim border is not supported",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+// orientationProcessor records the orientation passed to the transformation
+type orientationProcessor struct {
+	resizerMock
+	orientation img.Orientation
+}
+
+func (p *orientationProcessor) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	p.orientation = config.Orientation
+	return p.resizerMock.Resize(config)
+}
+
+func TestService_Orientation(t *testing.T) {
+	proc := &orientationProcessor{}
+	s, err := img.NewService(&loaderMock{}, proc, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	s.Cache = img.NewMemoryCache(1024)
+
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&rotate=90&flip&flop=true",
+			ExpectedCode: http.StatusOK,
+			Description:  "Rotate, flip and flop",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(img.Orientation{Rotate: 90, Flip: true, Flop: true}, proc.orientation, "orientation"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&rotate=270",
+			ExpectedCode: http.StatusOK,
+			Description:  "Different orientation is not served from the cache",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(img.Orientation{Rotate: 270}, proc.orientation, "orientation"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&rotate=45",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Rotate should be one of 90, 180, 270",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&flip=abc",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Can't parse flip",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&flop=abc",
+			ExpectedCode: http.StatusBadRequest,
+			Description:  "Can't parse flop",
+		},
 	}
 
 	test.RunRequests(testCases)
@@ -573,6 +839,570 @@ func TestService_TrimBorder(t *testing.T) {
 	test.RunRequests(testCases)
 }
 
+func TestService_ProcessorHttpError(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/too_big.png/optimise",
+			ExpectedCode: http.StatusUnprocessableEntity,
+			Description:  "Error code from the processor",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+func TestService_Cache(t *testing.T) {
+	s := createService(t)
+	s.Cache = img.NewMemoryCache(1024)
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	webpRequest := func() *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200", t),
+			Header: map[string][]string{
+				"Accept": {"image/webp,image/*,*/*;q=0.8"},
+			},
+		}
+	}
+	expectWebp := func(w *httptest.ResponseRecorder, t *testing.T) {
+		test.Error(t,
+			test.Equal(ImgWebpOut, w.Body.String(), "Resulted image"),
+			test.Equal("image/webp", w.Header().Get("Content-Type"), "Content-Type header"),
+			test.Equal("public, max-age=86400", w.Header().Get("Cache-Control"), "Cache-Control header"),
+		)
+	}
+
+	testCases := []test.TestCase{
+		{
+			Request:      webpRequest(),
+			ExpectedCode: http.StatusOK,
+			Description:  "Cache miss",
+			Handler:      expectWebp,
+		},
+		{
+			Request:      webpRequest(),
+			ExpectedCode: http.StatusOK,
+			Description:  "Cache hit",
+			Handler:      expectWebp,
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200",
+			ExpectedCode: http.StatusOK,
+			Description:  "Different output format",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgPngOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200&dppx=2",
+			ExpectedCode: http.StatusOK,
+			Description:  "Different quality",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(ImgLowerQualityOut, w.Body.String(), "Resulted image"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=300x200",
+			ExpectedCode: http.StatusOK,
+			Description:  "Different operation",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x100",
+			ExpectedCode: http.StatusInternalServerError,
+			Description:  "Errors are not cached",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x100",
+			ExpectedCode: http.StatusInternalServerError,
+			Description:  "Errors are not cached",
+		},
+	}
+
+	test.RunRequests(testCases)
+
+	hits, misses := s.CacheStats()
+	test.Error(t,
+		test.Equal(uint64(1), hits, "cache hits"),
+		test.Equal(uint64(6), misses, "cache misses"),
+	)
+}
+
+func TestService_Metrics(t *testing.T) {
+	router := createService(t).GetRouter()
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/fit?size=abc", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	expected := []string{
+		`transformimgs_requests_total{code="400",operation="fit"}`,
+		`transformimgs_requests_total{code="200",operation="optimise"}`,
+		`transformimgs_source_bytes_total{operation="optimise"}`,
+		`transformimgs_queue_wait_seconds_count{queue="transformations"}`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("expected metric [%s] in the output", e)
+		}
+	}
+}
+
+func TestService_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+	req.Header.Set("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	createService(t).GetRouter().ServeHTTP(w, req)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		if span.SpanContext.TraceID().String() != traceId {
+			t.Errorf("expected span [%s] to be in trace [%s], but got [%s]", span.Name, traceId, span.SpanContext.TraceID())
+		}
+	}
+
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code"),
+		test.Equal(true, spans["optimise"].Name == "optimise", "request span"),
+		test.Equal(true, spans["load"].Name == "load", "load span"),
+		test.Equal(spans["optimise"].SpanContext.SpanID(), spans["load"].Parent.SpanID(), "parent of load span"),
+	)
+}
+
+// debugProcessor records the decisions made during the transformation
+type debugProcessor struct {
+	resizerMock
+}
+
+func (p *debugProcessor) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	img.StatsFromContext(config.Context).SetDebug(img.DebugOutputFormat, "image/webp")
+	img.StatsFromContext(config.Context).AddTiming("convert", 5*time.Millisecond)
+	return p.resizerMock.Optimise(config)
+}
+
+func TestService_StatsHeaders(t *testing.T) {
+	img.ServerTimingEnabled = true
+	img.DebugHeadersEnabled = true
+	defer func() {
+		img.ServerTimingEnabled = false
+		img.DebugHeadersEnabled = false
+	}()
+
+	s, err := img.NewService(&loaderMock{}, &debugProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	s.Cache = img.NewMemoryCache(1024)
+	router := s.GetRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+
+	serverTiming := w.Header().Get("Server-Timing")
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code"),
+		test.Equal(true, strings.HasPrefix(serverTiming, "load;dur="), "load timing"),
+		test.Equal(true, strings.Contains(serverTiming, ", queue-wait;dur="), "queue-wait timing"),
+		test.Equal(true, strings.HasSuffix(serverTiming, ", convert;dur=5.0"), "convert timing"),
+		test.Equal("image/webp", w.Header().Get(img.DebugOutputFormat), "output format"),
+		test.Equal("3", w.Header().Get(img.DebugSourceBytes), "source bytes"),
+		test.Equal("3", w.Header().Get(img.DebugOutputBytes), "output bytes"),
+	)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "cached response code"),
+		test.Equal(true, strings.HasPrefix(w.Header().Get("Server-Timing"), "cache;dur="), "cache timing"),
+	)
+}
+
+func TestService_StatsHeadersDisabled(t *testing.T) {
+	w := httptest.NewRecorder()
+	createService(t).GetRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code"),
+		test.Equal("", w.Header().Get("Server-Timing"), "Server-Timing header"),
+		test.Equal("", w.Header().Get(img.DebugSourceBytes), "source bytes"),
+	)
+}
+
+func TestService_DisabledFormats(t *testing.T) {
+	s := createService(t)
+	s.DisabledFormats = []string{"image/avif"}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil)
+	req.Header.Set("Accept", "image/avif, image/webp")
+	w := httptest.NewRecorder()
+	s.GetRouter().ServeHTTP(w, req)
+
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code"),
+		test.Equal(ImgWebpOut, w.Body.String(), "result image"),
+	)
+}
+
+func TestService_ErrorCacheTTL(t *testing.T) {
+	img.ErrorCacheTTL = 60
+	defer func() {
+		img.ErrorCacheTTL = 0
+	}()
+
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/custom_error.png/optimise",
+			ExpectedCode: http.StatusTeapot,
+			Description:  "Loader error",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("public, max-age=60", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/too_big.png/optimise",
+			ExpectedCode: http.StatusUnprocessableEntity,
+			Description:  "Processor error",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("public, max-age=60", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/unknown.png/optimise",
+			ExpectedCode: http.StatusInternalServerError,
+			Description:  "Server error is not cached",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+// countingProcessor counts calls to the processor
+type countingProcessor struct {
+	resizerMock
+	calls int32
+}
+
+func (p *countingProcessor) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	atomic.AddInt32(&p.calls, 1)
+	return p.resizerMock.Resize(config)
+}
+
+func TestService_ETag(t *testing.T) {
+	for _, withCache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache %t", withCache), func(t *testing.T) {
+			p := &countingProcessor{}
+			s, err := img.NewService(&loaderMock{}, p, 1)
+			if err != nil {
+				t.Fatalf("Error while creating service: %+v", err)
+			}
+			if withCache {
+				s.Cache = img.NewMemoryCache(1024)
+			}
+			router := s.GetRouter()
+
+			request := func(url string, ifNoneMatch string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, url, nil)
+				req.Header.Set("Accept", "image/webp")
+				if len(ifNoneMatch) > 0 {
+					req.Header.Set("If-None-Match", ifNoneMatch)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				return w
+			}
+
+			resizeUrl := "http://localhost/img/http%3A%2F%2Fsite.com/etag.png/resize?size=300x200"
+			w := request(resizeUrl, "")
+			etag := w.Header().Get("ETag")
+			wOtherSize := request("http://localhost/img/http%3A%2F%2Fsite.com/etag.png/resize?size=300x100", "")
+
+			test.Error(t,
+				test.Equal(http.StatusOK, w.Code, "status code"),
+				test.Equal(ImgWebpOut, w.Body.String(), "resulted image"),
+				test.Equal(true, len(etag) > 2 && etag[0] == '"', "strong ETag"),
+				test.Equal(true, etag != wOtherSize.Header().Get("ETag"), "ETag depends on transformation"),
+			)
+
+			callsBefore := atomic.LoadInt32(&p.calls)
+			wNotModified := request(resizeUrl, `"other", `+etag)
+			wModified := request(resizeUrl, `"other"`)
+
+			test.Error(t,
+				test.Equal(http.StatusNotModified, wNotModified.Code, "status code"),
+				test.Equal("", wNotModified.Body.String(), "empty body"),
+				test.Equal(etag, wNotModified.Header().Get("ETag"), "ETag header"),
+				test.Equal("public, max-age=86400", wNotModified.Header().Get("Cache-Control"), "Cache-Control header"),
+				test.Equal(http.StatusOK, wModified.Code, "status code"),
+				test.Equal(etag, wModified.Header().Get("ETag"), "ETag header"),
+			)
+			if withCache {
+				test.Error(t, test.Equal(callsBefore, atomic.LoadInt32(&p.calls), "processor calls"))
+			} else {
+				test.Error(t, test.Equal(callsBefore+1, atomic.LoadInt32(&p.calls), "processor calls"))
+			}
+		})
+	}
+}
+
+func TestService_AsIsConditional(t *testing.T) {
+	test.Service = createService(t).GetRouter().ServeHTTP
+	test.T = t
+
+	conditionalRequest := func(header string, value string) *http.Request {
+		return &http.Request{
+			Method: "GET",
+			URL:    parseUrl("http://localhost/img/http%3A%2F%2Fsite.com/etag.png/asis", t),
+			Header: map[string][]string{
+				header: {value},
+			},
+		}
+	}
+
+	testCases := []test.TestCase{
+		{
+			Description: "Origin validators",
+			Url:         "http://localhost/img/http%3A%2F%2Fsite.com/etag.png/asis",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(`"src-etag"`, w.Header().Get("ETag"), "ETag header"),
+					test.Equal("Mon, 02 Jan 2023 15:04:05 GMT", w.Header().Get("Last-Modified"), "Last-Modified header"),
+				)
+			},
+		},
+		{
+			Description:  "If-None-Match matches",
+			Request:      conditionalRequest("If-None-Match", `W/"src-etag"`),
+			ExpectedCode: http.StatusNotModified,
+		},
+		{
+			Description:  "If-None-Match doesn't match",
+			Request:      conditionalRequest("If-None-Match", `"other"`),
+			ExpectedCode: http.StatusOK,
+		},
+		{
+			Description:  "Not modified since",
+			Request:      conditionalRequest("If-Modified-Since", "Mon, 02 Jan 2023 15:04:05 GMT"),
+			ExpectedCode: http.StatusNotModified,
+		},
+		{
+			Description:  "Modified since",
+			Request:      conditionalRequest("If-Modified-Since", "Sun, 01 Jan 2023 15:04:05 GMT"),
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+// estimatingProcessor implements img.CostEstimator
+type estimatingProcessor struct {
+	resizerMock
+}
+
+func (p *estimatingProcessor) EstimateCost(config *img.TransformationConfig) (int, error) {
+	if string(config.Src.Data) == ImgTooBig {
+		return 0, img.NewHttpError(http.StatusUnprocessableEntity, "image is too big")
+	}
+	config.SrcInfo = &img.Info{Width: 1000, Height: 1000}
+	return 2, nil
+}
+
+func (p *estimatingProcessor) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	if config.SrcInfo == nil || config.SrcInfo.Width != 1000 {
+		return nil, errors.New("source info is not passed to the processor")
+	}
+	return p.resizerMock.Resize(config)
+}
+
+func TestService_CostEstimator(t *testing.T) {
+	s, err := img.NewService(&loaderMock{}, &estimatingProcessor{}, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200",
+			ExpectedCode: http.StatusOK,
+			Description:  "Source info is passed to the processor",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/too_big.png/resize?size=300x200",
+			ExpectedCode: http.StatusUnprocessableEntity,
+			Description:  "Error while estimating cost",
+		},
+	}
+
+	test.RunRequests(testCases)
+}
+
+// trackingProcessor tracks the maximum number of transformations
+// that are executed at the same time
+type trackingProcessor struct {
+	resizerMock
+	running    int32
+	maxRunning int32
+}
+
+func (p *trackingProcessor) track() func() {
+	running := atomic.AddInt32(&p.running, 1)
+	for {
+		max := atomic.LoadInt32(&p.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(&p.maxRunning, max, running) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return func() {
+		atomic.AddInt32(&p.running, -1)
+	}
+}
+
+func (p *trackingProcessor) Resize(config *img.TransformationConfig) (*img.Image, error) {
+	defer p.track()()
+	return p.resizerMock.Resize(config)
+}
+
+// concurrencyProcessor tracks cost estimations as well as transformations
+type concurrencyProcessor struct {
+	trackingProcessor
+}
+
+func (p *concurrencyProcessor) EstimateCost(config *img.TransformationConfig) (int, error) {
+	defer p.track()()
+	return 1, nil
+}
+
+// resizeConcurrently sends n resize requests at the same time and checks that all of them succeeded
+func resizeConcurrently(t *testing.T, router http.Handler, n int) {
+	done := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost/img/http%%3A%%2F%%2Fsite.com/img.png/resize?size=%dx200", 300+i), nil))
+			done <- w.Code
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		test.Error(t, test.Equal(http.StatusOK, <-done, "status code"))
+	}
+}
+
+func TestService_DefaultConcurrency(t *testing.T) {
+	p := &trackingProcessor{resizerMock: resizerMock{fuzzTests: true}}
+	s, err := img.NewService(&loaderMock{}, p, 2)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+
+	resizeConcurrently(t, s.GetRouter(), 10)
+
+	test.Error(t,
+		test.Equal(int32(2), atomic.LoadInt32(&p.maxRunning), "transformations executed at the same time"),
+	)
+}
+
+func TestService_CostEstimatorConcurrency(t *testing.T) {
+	p := &concurrencyProcessor{trackingProcessor{resizerMock: resizerMock{fuzzTests: true}}}
+	s, err := img.NewService(&loaderMock{}, p, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	s.Q.Budget = 2
+
+	resizeConcurrently(t, s.GetRouter(), 10)
+
+	test.Error(t,
+		test.Equal(true, atomic.LoadInt32(&p.maxRunning) <= 2, "estimations and transformations are within the budget"),
+	)
+}
+
+// blockingProcessor signals when optimisation is started
+// and waits for the release channel to be closed
+type blockingProcessor struct {
+	resizerMock
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingProcessor) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	close(p.started)
+	<-p.release
+	return p.resizerMock.Optimise(config)
+}
+
+func TestService_QueueMaxWait(t *testing.T) {
+	img.ErrorCacheTTL = 60
+	defer func() {
+		img.ErrorCacheTTL = 0
+	}()
+
+	p := &blockingProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	s, err := img.NewService(&loaderMock{}, p, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	s.Q.Budget = 1
+	s.Q.MaxWait = 10 * time.Millisecond
+	router := s.GetRouter()
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise", nil))
+		close(done)
+	}()
+	<-p.started
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200", nil))
+
+	close(p.release)
+	<-done
+
+	test.Error(t,
+		test.Equal(http.StatusServiceUnavailable, w.Code, "status code"),
+		test.Equal("1", w.Header().Get("Retry-After"), "Retry-After header"),
+		test.Equal("no-store", w.Header().Get("Cache-Control"), "Cache-Control header"),
+	)
+}
+
 func TestService_AsIs(t *testing.T) {
 	test.Service = createService(t).GetRouter().ServeHTTP
 	test.T = t
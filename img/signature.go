@@ -0,0 +1,128 @@
+package img
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// SignatureParam is the query parameter with the signature of the URL.
+	SignatureParam = "sig"
+	// ExpiresParam is the optional query parameter with the expiry time of the signed URL
+	// as a Unix timestamp in seconds. It's signed together with other parameters.
+	ExpiresParam = "expires"
+)
+
+// Signer signs URLs of the service and verifies signatures, so only URLs generated
+// by the owner of the key could be transformed.
+//
+// The signature is HMAC-SHA256 over the decoded path and the query of the URL sorted by
+// parameter name excluding the signature itself. It's encoded using URL-safe base64 without padding.
+type Signer struct {
+	// Keys are the secret keys. The first key is used to sign URLs and all keys are used to
+	// verify signatures, so the new key could be added in front of the old one for rotation.
+	Keys [][]byte
+}
+
+// NewSigner creates a new Signer with the given keys. The first key is used to sign URLs.
+func NewSigner(keys ...string) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one key is required")
+	}
+
+	s := &Signer{}
+	for _, k := range keys {
+		if len(k) == 0 {
+			return nil, fmt.Errorf("key must not be empty")
+		}
+		s.Keys = append(s.Keys, []byte(k))
+	}
+
+	return s, nil
+}
+
+// Sign returns the URL with the signature added to the query. rawUrl could be
+// a path with the query, e.g. /img/https%3A%2F%2Fsite.com%2Fimg.png/resize?size=300,
+// or an absolute URL in which case only the path and the query are signed.
+func (s *Signer) Sign(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if len(s.Keys) == 0 {
+		return "", fmt.Errorf("signing key is not set")
+	}
+
+	query := u.Query()
+	query.Del(SignatureParam)
+	query.Set(SignatureParam, signature(s.Keys[0], u.Path, query))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// SignWithExpiry returns the URL with the signature that is valid until the expires time.
+func (s *Signer) SignWithExpiry(rawUrl string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	u.RawQuery = query.Encode()
+
+	return s.Sign(u.String())
+}
+
+// Verify checks the signature of the URL. Returns 403 HttpError if the signature
+// is missing, doesn't match any of the keys or expired.
+func (s *Signer) Verify(u *url.URL) error {
+	query := u.Query()
+	sig := query.Get(SignatureParam)
+	if len(sig) == 0 {
+		return NewHttpError(http.StatusForbidden, "signature is required")
+	}
+	query.Del(SignatureParam)
+
+	valid := false
+	for _, key := range s.Keys {
+		if hmac.Equal([]byte(sig), []byte(signature(key, u.Path, query))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return NewHttpError(http.StatusForbidden, "signature is not valid")
+	}
+
+	if expiresParam := query.Get(ExpiresParam); len(expiresParam) > 0 {
+		expires, err := strconv.ParseInt(expiresParam, 10, 64)
+		if err != nil {
+			return NewHttpError(http.StatusForbidden, "expires param must be a Unix timestamp")
+		}
+		if time.Now().Unix() > expires {
+			return NewHttpError(http.StatusForbidden, "signature is expired")
+		}
+	}
+
+	return nil
+}
+
+// signature returns HMAC of the path and the query. Query is encoded
+// in the canonical form with parameters sorted by name.
+func signature(key []byte, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	if len(query) > 0 {
+		mac.Write([]byte{'?'})
+		mac.Write([]byte(query.Encode()))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
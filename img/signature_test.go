@@ -0,0 +1,130 @@
+package img_test
+
+import (
+	"errors"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func verify(t *testing.T, signer *img.Signer, signedUrl string) int {
+	u, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Fatalf("could not parse URL [%s]: %s", signedUrl, err)
+	}
+	err = signer.Verify(u)
+	if err == nil {
+		return http.StatusOK
+	}
+	var httpErr *img.HttpError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected HttpError, but got [%v]", err)
+	}
+	return httpErr.Code()
+}
+
+func TestNewSigner(t *testing.T) {
+	_, noKeysErr := img.NewSigner()
+	_, emptyKeyErr := img.NewSigner("key", "")
+
+	test.Error(t,
+		test.NotNil(noKeysErr, "error without keys"),
+		test.NotNil(emptyKeyErr, "error with empty key"),
+	)
+}
+
+func TestSigner_Sign(t *testing.T) {
+	signer, _ := img.NewSigner("secret")
+
+	signed, err := signer.Sign("/img/https%3A%2F%2Fsite.com%2Fimg.png/resize?size=300&dppx=2")
+	if err != nil {
+		t.Fatalf("could not sign URL: %s", err)
+	}
+	absolute, _ := signer.Sign("https://cdn.com/img/https%3A%2F%2Fsite.com%2Fimg.png/resize?dppx=2&size=300")
+
+	test.Error(t,
+		test.Equal(true, strings.HasPrefix(signed, "/img/https%3A%2F%2Fsite.com%2Fimg.png/resize?"), "path is preserved"),
+		test.Equal(true, strings.Contains(signed, "&sig="), "signature param"),
+		test.Equal("https://cdn.com"+signed, absolute, "signature of absolute URL"),
+		test.Equal(http.StatusOK, verify(t, signer, signed), "valid signature"),
+		test.Equal(http.StatusForbidden, verify(t, signer, strings.Replace(signed, "size=300", "size=9999", 1)), "tampered query"),
+		test.Equal(http.StatusForbidden, verify(t, signer, strings.Replace(signed, "resize", "fit", 1)), "tampered path"),
+		test.Equal(http.StatusForbidden, verify(t, signer, "/img/https%3A%2F%2Fsite.com%2Fimg.png/resize?size=300"), "no signature"),
+	)
+}
+
+func TestSigner_KeysRotation(t *testing.T) {
+	oldSigner, _ := img.NewSigner("old")
+	newSigner, _ := img.NewSigner("new", "old")
+	otherSigner, _ := img.NewSigner("other")
+
+	oldSigned, _ := oldSigner.Sign("/img/site.com/img.png/optimise")
+	newSigned, _ := newSigner.Sign("/img/site.com/img.png/optimise")
+
+	test.Error(t,
+		test.Equal(http.StatusOK, verify(t, newSigner, oldSigned), "signed with the old key"),
+		test.Equal(http.StatusOK, verify(t, newSigner, newSigned), "signed with the new key"),
+		test.Equal(http.StatusForbidden, verify(t, oldSigner, newSigned), "old signer with the new key"),
+		test.Equal(http.StatusForbidden, verify(t, otherSigner, newSigned), "signed with the other key"),
+	)
+}
+
+func TestSigner_SignWithExpiry(t *testing.T) {
+	signer, _ := img.NewSigner("secret")
+
+	valid, _ := signer.SignWithExpiry("/img/site.com/img.png/optimise", time.Now().Add(time.Hour))
+	expired, _ := signer.SignWithExpiry("/img/site.com/img.png/optimise", time.Now().Add(-time.Hour))
+
+	test.Error(t,
+		test.Equal(true, strings.Contains(valid, "expires="), "expires param"),
+		test.Equal(http.StatusOK, verify(t, signer, valid), "valid signature"),
+		test.Equal(http.StatusForbidden, verify(t, signer, expired), "expired signature"),
+	)
+}
+
+func TestService_Signature(t *testing.T) {
+	signer, _ := img.NewSigner("secret")
+	s := createService(t)
+	s.Signer = signer
+
+	signedResize, _ := signer.Sign("http://localhost/img/http%3A%2F%2Fsite.com/img.png/resize?size=300x200")
+	signedAsIs, _ := signer.Sign("http://localhost/img/http%3A%2F%2Fsite.com/img.png/asis")
+
+	test.Service = s.GetRouter().ServeHTTP
+	test.T = t
+
+	testCases := []test.TestCase{
+		{
+			Url:          signedResize,
+			ExpectedCode: http.StatusOK,
+			Description:  "Signed resize",
+		},
+		{
+			Url:          signedAsIs,
+			ExpectedCode: http.StatusOK,
+			Description:  "Signed asis",
+		},
+		{
+			Url:          strings.Replace(signedResize, "300x200", "3000x2000", 1),
+			ExpectedCode: http.StatusForbidden,
+			Description:  "Tampered size",
+		},
+		{
+			Url:          "http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise",
+			ExpectedCode: http.StatusForbidden,
+			Description:  "No signature",
+			Handler: func(w *httptest.ResponseRecorder, t *testing.T) {
+				test.Error(t,
+					test.Equal(true, strings.Contains(w.Body.String(), "signature is required"), "error message"),
+				)
+			},
+		},
+	}
+
+	test.RunRequests(testCases)
+}
@@ -0,0 +1,149 @@
+package img
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServerTimingEnabled is the flag to enable/disable Server-Timing response header
+// with the time spent on loading and transforming the image.
+var ServerTimingEnabled = false
+
+// DebugHeadersEnabled is the flag to enable/disable X-Transform-* response headers
+// with the decisions made during the transformation, e.g. the chosen output format and quality.
+var DebugHeadersEnabled = false
+
+// Debug headers that are added to the response when DebugHeadersEnabled is true.
+const (
+	DebugSourceFormat  = "X-Transform-Source-Format"
+	DebugSourceQuality = "X-Transform-Source-Quality"
+	DebugIllustration  = "X-Transform-Illustration"
+	DebugOutputFormat  = "X-Transform-Output-Format"
+	DebugQuality       = "X-Transform-Quality"
+	DebugSourceBytes   = "X-Transform-Source-Bytes"
+	DebugOutputBytes   = "X-Transform-Output-Bytes"
+)
+
+// Stats collects timings of the transformation stages and the decisions made by
+// the processor, so they could be returned to the client in the response headers.
+//
+// All methods are safe to call on nil Stats, in which case nothing is collected.
+type Stats struct {
+	mux     sync.Mutex
+	timings []Timing
+	debug   http.Header
+}
+
+// Timing is the time spent on the stage of the transformation.
+type Timing struct {
+	Name     string
+	Duration time.Duration
+}
+
+type statsKey int
+
+const statsCtxKey statsKey = 0
+
+// NewContextWithStats returns a copy of ctx that collects stats into the given Stats.
+func NewContextWithStats(ctx context.Context, stats *Stats) context.Context {
+	return context.WithValue(ctx, statsCtxKey, stats)
+}
+
+// StatsFromContext returns Stats of the context or nil if the context doesn't collect stats.
+func StatsFromContext(ctx context.Context) *Stats {
+	if ctx == nil {
+		return nil
+	}
+	stats, _ := ctx.Value(statsCtxKey).(*Stats)
+	return stats
+}
+
+// AddTiming records the time spent on the stage. Timings of the same stage are summed up.
+func (s *Stats) AddTiming(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for i := range s.timings {
+		if s.timings[i].Name == name {
+			s.timings[i].Duration += d
+			return
+		}
+	}
+	s.timings = append(s.timings, Timing{Name: name, Duration: d})
+}
+
+// SetDebug records the value of the debug header, e.g. DebugOutputFormat.
+func (s *Stats) SetDebug(header string, value string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.debug == nil {
+		s.debug = make(http.Header)
+	}
+	s.debug.Set(header, value)
+}
+
+// Timings returns the recorded timings in the order stages were executed.
+func (s *Stats) Timings() []Timing {
+	if s == nil {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]Timing(nil), s.timings...)
+}
+
+// Debug returns the value of the debug header or an empty string if it wasn't recorded.
+func (s *Stats) Debug(header string) string {
+	if s == nil {
+		return ""
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.debug.Get(header)
+}
+
+// newStats returns new Stats if any of the stats headers is enabled, otherwise nil.
+func newStats() *Stats {
+	if !ServerTimingEnabled && !DebugHeadersEnabled {
+		return nil
+	}
+	return &Stats{}
+}
+
+// addStatsHeaders adds Server-Timing and debug headers to the response.
+func addStatsHeaders(resp http.ResponseWriter, stats *Stats) {
+	if stats == nil {
+		return
+	}
+
+	if ServerTimingEnabled {
+		var metrics []string
+		for _, t := range stats.Timings() {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", t.Name, float64(t.Duration.Microseconds())/1000))
+		}
+		if len(metrics) > 0 {
+			resp.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+		}
+	}
+
+	if DebugHeadersEnabled {
+		stats.mux.Lock()
+		for header, values := range stats.debug {
+			resp.Header()[header] = append([]string(nil), values...)
+		}
+		stats.mux.Unlock()
+	}
+}
@@ -1,5 +1,7 @@
 package img
 
+import "net/http"
+
 type Image struct {
 	// Id of the image mainly used for debugging purposes.
 	// Could be a URL of the image or a filename.
@@ -9,6 +11,12 @@ type Image struct {
 	// Content encoding is a literally Content-Encoding header from the response
 	// because of the #32 (https://github.com/Pixboost/transformimgs/issues/32)
 	ContentEncoding string
+	// ETag is the entity tag of the image. For source images it's the ETag header
+	// from the origin response, for transformed images it's generated by the service.
+	ETag string
+	// LastModified is the Last-Modified header from the origin response
+	// in the HTTP date format.
+	LastModified string
 }
 
 // Info holds basic information about an image.
@@ -31,18 +39,27 @@ type Info struct {
 // HttpError is user defined error that could be used for
 // customising responses of the service
 type HttpError struct {
-	code int
-	msg  string
+	code   int
+	msg    string
+	header http.Header
 }
 
 func NewHttpError(code int, msg string) *HttpError {
-	return &HttpError{code: code, msg: msg}
+	return &HttpError{code: code, msg: msg, header: make(http.Header)}
 }
 
 func (e *HttpError) Code() int {
 	return e.code
 }
 
+// Header returns headers that will be added to the response, e.g. Retry-After.
+func (e *HttpError) Header() http.Header {
+	if e.header == nil {
+		e.header = make(http.Header)
+	}
+	return e.header
+}
+
 func (e *HttpError) Error() string {
 	return e.msg
 }
@@ -0,0 +1,104 @@
+package img
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// WatermarkParam is the query parameter with the name of the watermark
+// that is composited on top of the transformed image.
+const WatermarkParam = "watermark"
+
+// Watermark is an overlay image that is composited on top of transformed images.
+// Watermarks are registered in Service.Watermarks, so clients could only request
+// them by name and can't use arbitrary images.
+type Watermark struct {
+	// Url is the URL of the overlay image that is loaded by Service.Loader.
+	Url string `json:"url" yaml:"url"`
+	// Gravity is the position of the overlay, e.g. GravitySouthEast. If empty then the overlay is in the center.
+	Gravity string `json:"gravity,omitempty" yaml:"gravity,omitempty"`
+	// Margin is the distance in pixels between the overlay and the edges of the image.
+	Margin int `json:"margin,omitempty" yaml:"margin,omitempty"`
+	// Opacity of the overlay from 0 to 1. If 0 then the overlay is composited as is.
+	Opacity float64 `json:"opacity,omitempty" yaml:"opacity,omitempty"`
+	// Scale is the width of the overlay relative to the width of the result image, e.g. 0.2.
+	// If 0 then the overlay is not resized.
+	Scale float64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+}
+
+// Overlay is the image that Processor composites on top of the result image.
+type Overlay struct {
+	Image *Image
+	// Gravity is the position of the overlay, e.g. GravitySouthEast. If empty then the overlay is in the center.
+	Gravity string
+	// Margin is the distance in pixels between the overlay and the edges of the image.
+	Margin int
+	// Opacity of the overlay from 0 to 1. If 0 then the overlay is composited as is.
+	Opacity float64
+	// Scale is the width of the overlay relative to the width of the result image.
+	// If 0 then the overlay is not resized.
+	Scale float64
+}
+
+// Validate returns error if the watermark is not configured properly.
+func (w *Watermark) Validate() error {
+	if len(w.Url) == 0 {
+		return fmt.Errorf("url is required")
+	}
+	if len(w.Gravity) > 0 && !gravities[w.Gravity] {
+		return fmt.Errorf("unknown gravity [%s]", w.Gravity)
+	}
+	if w.Margin < 0 {
+		return fmt.Errorf("margin must not be negative, but got [%d]", w.Margin)
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("opacity must be between 0 and 1, but got [%g]", w.Opacity)
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("scale must be between 0 and 1, but got [%g]", w.Scale)
+	}
+	return nil
+}
+
+// overlays caches images of watermarks, so they are loaded only once.
+type overlays struct {
+	mux    sync.Mutex
+	images map[string]*Image
+}
+
+// overlay returns the overlay of the watermark loading its image if it's not loaded yet.
+// Errors are not cached, so the image is loaded again by the next request.
+func (r *Service) overlay(ctx context.Context, watermark *Watermark) (*Overlay, error) {
+	if watermark == nil {
+		return nil, nil
+	}
+
+	r.overlays.mux.Lock()
+	image, ok := r.overlays.images[watermark.Url]
+	r.overlays.mux.Unlock()
+
+	if !ok {
+		var err error
+		image, err = r.load(ctx, watermark.Url)
+		if err != nil {
+			Log.Printf("Could not load watermark [%s]: %s\n", watermark.Url, err)
+			return nil, err
+		}
+
+		r.overlays.mux.Lock()
+		if r.overlays.images == nil {
+			r.overlays.images = make(map[string]*Image)
+		}
+		r.overlays.images[watermark.Url] = image
+		r.overlays.mux.Unlock()
+	}
+
+	return &Overlay{
+		Image:   image,
+		Gravity: watermark.Gravity,
+		Margin:  watermark.Margin,
+		Opacity: watermark.Opacity,
+		Scale:   watermark.Scale,
+	}, nil
+}
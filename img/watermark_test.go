@@ -0,0 +1,128 @@
+package img_test
+
+import (
+	"context"
+	"github.com/Pixboost/transformimgs/v8/img"
+	"github.com/dooman87/kolibri/test"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	LogoUrl  = "http://site.com/logo.png"
+	LogoData = "555"
+)
+
+// watermarkLoader serves the logo and counts how many times it was loaded
+type watermarkLoader struct {
+	loaderMock
+	logoLoads int32
+}
+
+func (l *watermarkLoader) Load(url string, ctx context.Context) (*img.Image, error) {
+	if url == LogoUrl {
+		atomic.AddInt32(&l.logoLoads, 1)
+		return &img.Image{
+			Data:     []byte(LogoData),
+			MimeType: "image/png",
+			Id:       url,
+		}, nil
+	}
+	return l.loaderMock.Load(url, ctx)
+}
+
+// overlayProcessor records the overlay passed to the transformation
+type overlayProcessor struct {
+	resizerMock
+	overlay *img.Overlay
+	calls   int
+}
+
+func (p *overlayProcessor) Optimise(config *img.TransformationConfig) (*img.Image, error) {
+	p.overlay = config.Overlay
+	p.calls++
+	return p.resizerMock.Optimise(config)
+}
+
+func TestService_Watermark(t *testing.T) {
+	loader := &watermarkLoader{}
+	proc := &overlayProcessor{}
+	s, err := img.NewService(loader, proc, 1)
+	if err != nil {
+		t.Fatalf("Error while creating service: %+v", err)
+	}
+	s.Cache = img.NewMemoryCache(1024)
+	s.Watermarks = map[string]*img.Watermark{
+		"logo":   {Url: LogoUrl, Gravity: img.GravitySouthEast, Margin: 10, Opacity: 0.5, Scale: 0.2},
+		"broken": {Url: "http://site.com/custom_error.png"},
+	}
+	router := s.GetRouter()
+
+	request := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	w := request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?watermark=logo")
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code"),
+		test.NotNil(proc.overlay, "overlay"),
+	)
+	if proc.overlay != nil {
+		test.Error(t,
+			test.Equal(LogoData, string(proc.overlay.Image.Data), "overlay image"),
+			test.Equal(img.GravitySouthEast, proc.overlay.Gravity, "overlay gravity"),
+			test.Equal(10, proc.overlay.Margin, "overlay margin"),
+			test.Equal(0.5, proc.overlay.Opacity, "overlay opacity"),
+			test.Equal(0.2, proc.overlay.Scale, "overlay scale"),
+		)
+	}
+
+	w = request("http://localhost/img/http%3A%2F%2Fsite.com/img2.png/optimise?watermark=logo")
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code of another image"),
+		test.Equal(int32(1), atomic.LoadInt32(&loader.logoLoads), "watermark is loaded once"),
+	)
+
+	w = request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise")
+	test.Error(t,
+		test.Equal(http.StatusOK, w.Code, "response code without watermark"),
+		test.Nil(proc.overlay, "overlay without watermark"),
+		test.Equal(3, proc.calls, "image without watermark is not served from the cache"),
+	)
+
+	w = request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?watermark=unknown")
+	test.Error(t,
+		test.Equal(http.StatusBadRequest, w.Code, "response code of unknown watermark"),
+	)
+
+	w = request("http://localhost/img/http%3A%2F%2Fsite.com/img.png/optimise?watermark=broken")
+	test.Error(t,
+		test.Equal(http.StatusTeapot, w.Code, "response code of watermark that can't be loaded"),
+	)
+}
+
+func TestWatermark_Validate(t *testing.T) {
+	tests := []struct {
+		watermark *img.Watermark
+		valid     bool
+	}{
+		{&img.Watermark{Url: LogoUrl}, true},
+		{&img.Watermark{Url: LogoUrl, Gravity: img.GravityNorthWest, Margin: 5, Opacity: 1, Scale: 0.3}, true},
+		{&img.Watermark{}, false},
+		{&img.Watermark{Url: LogoUrl, Gravity: img.GravityFocus}, false},
+		{&img.Watermark{Url: LogoUrl, Margin: -1}, false},
+		{&img.Watermark{Url: LogoUrl, Opacity: 1.5}, false},
+		{&img.Watermark{Url: LogoUrl, Scale: 2}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.watermark.Validate()
+		if tt.valid != (err == nil) {
+			t.Errorf("expected watermark %+v to be valid [%t], but got error [%v]", tt.watermark, tt.valid, err)
+		}
+	}
+}
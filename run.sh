@@ -2,4 +2,4 @@
 
 set -e
 
-go run cmd/main.go -imConvert=/usr/local/bin/convert -imIdentify=/usr/local/bin/identify $@
+go run ./cmd -imConvert=/usr/local/bin/convert -imIdentify=/usr/local/bin/identify $@